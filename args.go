@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Split a command line into arguments.
+// Arguments are separated by whitespace. Double quotes group an argument that contains
+// whitespace, and \" produces a literal double quote. Backslashes are otherwise left
+// alone, because they are path separators on Windows.
+// For example: "C:\Program Files\IMQS\tool.exe" import -name "a \"quoted\" word"
+func SplitCommandLine(cmdline string) ([]string, error) {
+	args := []string{}
+	var arg strings.Builder
+	inArg := false
+	inQuotes := false
+	runes := []rune(cmdline)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && runes[i+1] == '"':
+			arg.WriteRune('"')
+			inArg = true
+			i++
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("Unterminated quote in command line")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Substitute variables into each parameter individually, so that a variable whose
+// value contains spaces does not get split into multiple arguments.
+func substituteParams(params []string, variables map[string]string) []string {
+	result := make([]string, len(params))
+	for i, p := range params {
+		result[i] = substitute_variables(p, variables)
+	}
+	return result
+}
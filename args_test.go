@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := []struct {
+		cmdline  string
+		expected []string
+	}{
+		{``, []string{}},
+		{`tool.exe`, []string{"tool.exe"}},
+		{`  tool.exe   import  -x `, []string{"tool.exe", "import", "-x"}},
+		{`"C:\Program Files\IMQS\tool.exe" import`, []string{`C:\Program Files\IMQS\tool.exe`, "import"}},
+		{`tool -src="c:\my imports\x" -y`, []string{"tool", `-src=c:\my imports\x`, "-y"}},
+		{`tool "" x`, []string{"tool", "", "x"}},
+		{`tool "a \"quoted\" word"`, []string{"tool", `a "quoted" word`}},
+		{`tool c:\imqsvar\`, []string{"tool", `c:\imqsvar\`}},
+	}
+	for _, c := range cases {
+		args, err := SplitCommandLine(c.cmdline)
+		if err != nil {
+			t.Errorf("Failed to split %v: %v", c.cmdline, err)
+		} else if !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("Split %v: expected %q, but got %q", c.cmdline, c.expected, args)
+		}
+	}
+	if _, err := SplitCommandLine(`tool "unterminated`); err == nil {
+		t.Errorf("Expected unterminated quote to fail")
+	}
+}
+
+func TestSubstituteParams(t *testing.T) {
+	variables := map[string]string{
+		"LOCATOR_SRC": `C:\Program Files\imports`,
+	}
+	params := substituteParams([]string{"import", "-src", "!LOCATOR_SRC", "x y"}, variables)
+	expected := []string{"import", "-src", `C:\Program Files\imports`, "x y"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Expected %q, but got %q", expected, params)
+	}
+}
@@ -0,0 +1,166 @@
+package scheduler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authentication of the HTTP API.
+//
+// A client identifies itself with a token, in one of two ways:
+//
+// Bearer token. The secret is sent as-is, so this should only be used over a trusted network:
+//
+//	Authorization: Bearer <secret>
+//
+// HMAC signed request. The secret never leaves the client:
+//
+//	Authorization: IMQS-HMAC <token name>:<unix timestamp>:<signature>
+//
+// where signature is the hex encoded HMAC-SHA256, keyed by the secret, of
+//
+//	METHOD + "\n" + path?query + "\n" + timestamp + "\n" + body
+//
+// The timestamp must be within a few minutes of our clock, which limits the window
+// in which a captured request can be replayed.
+
+// Something that a token may be allowed to do
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"    // Read the status of commands and runs
+	PermissionTrigger Permission = "trigger" // Run commands
+	PermissionCancel  Permission = "cancel"  // Cancel running commands
+	PermissionAdmin   Permission = "admin"   // Everything
+)
+
+const hmacScheme = "IMQS-HMAC"
+
+// How far the timestamp of a signed request may be from our clock
+const hmacMaxSkew = 5 * time.Minute
+
+// We need to read the body of a signed request, so we limit its size
+const hmacMaxBody = 1024 * 1024
+
+// A token that clients use to access the API
+type ApiToken struct {
+	Name        string
+	Secret      string
+	Permissions []Permission
+	Commands    []string // If Commands or Pools is not empty, then trigger and cancel are limited to these commands,
+	Pools       []string // and the commands in these pools
+}
+
+// Decides who may use the API. If there are no tokens, then authentication is disabled, and
+// everybody may do everything. This is how the scheduler behaved before we had tokens.
+type Authorizer struct {
+	Tokens []*ApiToken
+}
+
+// Parse a permission, such as "read" or "trigger"
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(strings.ToLower(strings.TrimSpace(s))); p {
+	case PermissionRead, PermissionTrigger, PermissionCancel, PermissionAdmin:
+		return p, nil
+	}
+	return "", fmt.Errorf("Invalid permission '%v'. Must be read, trigger, cancel, or admin", s)
+}
+
+// Returns true if authentication is required
+func (a *Authorizer) Enabled() bool {
+	return a != nil && len(a.Tokens) != 0
+}
+
+// Find the token of the request. If the request is signed, then its body is read, and replaced,
+// so that the handler can still read it.
+func (a *Authorizer) Authenticate(r *http.Request, now time.Time) (*ApiToken, error) {
+	auth := r.Header.Get("Authorization")
+	scheme, credentials, _ := strings.Cut(auth, " ")
+	switch {
+	case auth == "":
+		return nil, errors.New("Authorization required")
+	case strings.EqualFold(scheme, "Bearer"):
+		for _, t := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Secret), []byte(credentials)) == 1 {
+				return t, nil
+			}
+		}
+		return nil, errors.New("Invalid token")
+	case scheme == hmacScheme:
+		return a.authenticateSigned(r, credentials, now)
+	}
+	return nil, fmt.Errorf("Unsupported authorization scheme '%v'", scheme)
+}
+
+func (a *Authorizer) authenticateSigned(r *http.Request, credentials string, now time.Time) (*ApiToken, error) {
+	parts := strings.Split(credentials, ":")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid signature format")
+	}
+	name, timestamp, signature := parts[0], parts[1], parts[2]
+	var token *ApiToken
+	for _, t := range a.Tokens {
+		if t.Name == name {
+			token = t
+		}
+	}
+	if token == nil {
+		return nil, errors.New("Invalid token")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid signature timestamp")
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, errors.New("Signature has expired")
+	}
+	body := []byte{}
+	if r.Body != nil {
+		if body, err = io.ReadAll(io.LimitReader(r.Body, hmacMaxBody+1)); err != nil {
+			return nil, err
+		}
+		if len(body) > hmacMaxBody {
+			return nil, errors.New("Request body is too large to sign")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	expected := SignRequest(token.Secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, errors.New("Invalid signature")
+	}
+	return token, nil
+}
+
+// Produce the signature of a request. This is used by clients, and by us to verify requests.
+func SignRequest(secret, method, requestURI, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, method+"\n"+requestURI+"\n"+timestamp+"\n")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns true if the token may do 'perm' to the command, which is in 'pool'.
+// For read and admin, the command is ignored.
+func (t *ApiToken) Allows(perm Permission, command, pool string) bool {
+	if slices.Contains(t.Permissions, PermissionAdmin) {
+		return true
+	}
+	if !slices.Contains(t.Permissions, perm) {
+		return false
+	}
+	if perm == PermissionRead || (len(t.Commands) == 0 && len(t.Pools) == 0) {
+		return true
+	}
+	return slices.Contains(t.Commands, command) || slices.Contains(t.Pools, pool)
+}
@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuthorizer() *Authorizer {
+	return &Authorizer{
+		Tokens: []*ApiToken{
+			{Name: "monitor", Secret: "monitor-secret", Permissions: []Permission{PermissionRead}},
+			{Name: "jobs", Secret: "jobs-secret", Permissions: []Permission{PermissionTrigger}, Commands: []string{"import"}, Pools: []string{"light"}},
+			{Name: "ops", Secret: "ops-secret", Permissions: []Permission{PermissionAdmin}},
+		},
+	}
+}
+
+func TestAuthenticateBearer(t *testing.T) {
+	a := testAuthorizer()
+	now := time.Date(2015, 07, 15, 5, 3, 20, 0, time.UTC)
+	r := httptest.NewRequest("GET", "/scheduler/commands", nil)
+	if _, err := a.Authenticate(r, now); err == nil {
+		t.Errorf("Request without a token must be rejected")
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := a.Authenticate(r, now); err == nil {
+		t.Errorf("Request with an invalid token must be rejected")
+	}
+	r.Header.Set("Authorization", "Bearer jobs-secret")
+	if token, err := a.Authenticate(r, now); err != nil || token.Name != "jobs" {
+		t.Errorf("Valid bearer token rejected: %v", err)
+	}
+}
+
+func TestAuthenticateSigned(t *testing.T) {
+	a := testAuthorizer()
+	now := time.Date(2015, 07, 15, 5, 3, 20, 0, time.UTC)
+	body := `{"LOCATOR_SRC":"c:\\imports"}`
+	sign := func(secret string, ts time.Time, uri string) string {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		return "IMQS-HMAC jobs:" + timestamp + ":" + SignRequest(secret, "POST", uri, timestamp, []byte(body))
+	}
+	uri := "/scheduler/commands/import/run?queue=1"
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	r.Header.Set("Authorization", sign("jobs-secret", now.Add(-time.Minute), uri))
+	if token, err := a.Authenticate(r, now); err != nil || token.Name != "jobs" {
+		t.Fatalf("Valid signature rejected: %v", err)
+	}
+	if raw, _ := io.ReadAll(r.Body); string(raw) != body {
+		t.Errorf("Body must still be readable after authentication, but got %q", raw)
+	}
+
+	cases := map[string]string{
+		"wrong secret":   sign("ops-secret", now, uri),
+		"expired":        sign("jobs-secret", now.Add(-time.Hour), uri),
+		"different URI":  sign("jobs-secret", now, "/scheduler/commands/backup/run"),
+		"missing fields": "IMQS-HMAC jobs:123",
+	}
+	for name, auth := range cases {
+		r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		if _, err := a.Authenticate(r, now); err == nil {
+			t.Errorf("Expected signature with %v to be rejected", name)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	a := testAuthorizer()
+	monitor, jobs, ops := a.Tokens[0], a.Tokens[1], a.Tokens[2]
+	if !monitor.Allows(PermissionRead, "", "") || monitor.Allows(PermissionTrigger, "import", "") {
+		t.Errorf("Read token permissions incorrect")
+	}
+	if !jobs.Allows(PermissionTrigger, "import", "") || !jobs.Allows(PermissionTrigger, "tiles", "light") {
+		t.Errorf("Trigger token must be allowed to run its commands and pools")
+	}
+	if jobs.Allows(PermissionTrigger, "backup", "db") || jobs.Allows(PermissionCancel, "import", "") || jobs.Allows(PermissionRead, "", "") {
+		t.Errorf("Trigger token is allowed too much")
+	}
+	if !ops.Allows(PermissionCancel, "backup", "db") || !ops.Allows(PermissionRead, "", "") {
+		t.Errorf("Admin token must be allowed everything")
+	}
+	if (&Authorizer{}).Enabled() {
+		t.Errorf("Authorizer without tokens must be disabled")
+	}
+	if _, err := ParsePermission("write"); err == nil {
+		t.Errorf("Expected invalid permission to be rejected")
+	}
+}
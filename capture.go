@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+)
+
+// How much of each output stream we keep in memory. A job that writes more than this
+// loses the middle of its output, so that a chatty job can't exhaust our memory.
+// The complete output is available in the run's output file, if there is one.
+const (
+	captureHeadLimit = 64 * 1024
+	captureTailLimit = 64 * 1024
+)
+
+// Captures the first and last bytes of a stream, and discards everything in between.
+// The tail is kept in a ring buffer, so memory use is fixed no matter how much is written.
+type captureBuffer struct {
+	headLimit int
+	tailLimit int
+	lock      sync.Mutex
+	head      []byte
+	tail      []byte // ring buffer, of at most tailLimit bytes
+	tailPos   int    // the oldest byte in tail, once tail is full
+	total     int64  // number of bytes written
+}
+
+func newCaptureBuffer(headLimit, tailLimit int) *captureBuffer {
+	return &captureBuffer{
+		headLimit: headLimit,
+		tailLimit: tailLimit,
+	}
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := len(p)
+	b.total += int64(n)
+	if len(b.head) < b.headLimit {
+		take := min(len(p), b.headLimit-len(b.head))
+		b.head = append(b.head, p[:take]...)
+		p = p[take:]
+	}
+	if b.tailLimit == 0 || len(p) == 0 {
+		return n, nil
+	}
+	if len(p) >= b.tailLimit {
+		// Only the end of p survives
+		b.tail = append(b.tail[:0], p[len(p)-b.tailLimit:]...)
+		b.tailPos = 0
+		return n, nil
+	}
+	if len(b.tail) < b.tailLimit {
+		take := min(len(p), b.tailLimit-len(b.tail))
+		b.tail = append(b.tail, p[:take]...)
+		p = p[take:]
+	}
+	for len(p) != 0 {
+		c := copy(b.tail[b.tailPos:], p)
+		p = p[c:]
+		b.tailPos = (b.tailPos + c) % b.tailLimit
+	}
+	return n, nil
+}
+
+// Returns the captured output. If anything was discarded, then a marker is placed where it was.
+func (b *captureBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tail := append(append([]byte{}, b.tail[b.tailPos:]...), b.tail[:b.tailPos]...)
+	dropped := b.total - int64(len(b.head)) - int64(len(tail))
+	if dropped == 0 {
+		return string(b.head) + string(tail)
+	}
+	return string(b.head) + fmt.Sprintf("\n...(%v bytes truncated)...\n", dropped) + string(tail)
+}
@@ -0,0 +1,47 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCaptureBuffer(t *testing.T) {
+	b := newCaptureBuffer(5, 5)
+	b.Write([]byte("hel"))
+	b.Write([]byte("lo"))
+	if s := b.String(); s != "hello" {
+		t.Errorf("Expected 'hello', but got %q", s)
+	}
+	b.Write([]byte(" wor"))
+	if s := b.String(); s != "hello wor" {
+		t.Errorf("Expected 'hello wor', but got %q", s)
+	}
+	// Wrap around the ring buffer, one byte at a time
+	for _, c := range "ld, and goodbye" {
+		b.Write([]byte{byte(c)})
+	}
+	if s := b.String(); s != "hello\n...(14 bytes truncated)...\nodbye" {
+		t.Errorf("Wrapped output incorrect: %q", s)
+	}
+
+	// A single write that is larger than the whole buffer
+	b = newCaptureBuffer(3, 4)
+	b.Write([]byte("abcdefghijklmnop"))
+	if s := b.String(); s != "abc\n...(9 bytes truncated)...\nmnop" {
+		t.Errorf("Large write incorrect: %q", s)
+	}
+	b.Write([]byte("qr"))
+	if s := b.String(); s != "abc\n...(11 bytes truncated)...\nopqr" {
+		t.Errorf("Write after large write incorrect: %q", s)
+	}
+
+	// Memory stays bounded
+	b = newCaptureBuffer(captureHeadLimit, captureTailLimit)
+	line := []byte(strings.Repeat("x", 1000) + "\n")
+	for i := 0; i < 10000; i++ {
+		b.Write(line)
+	}
+	if len(b.head) != captureHeadLimit || len(b.tail) != captureTailLimit {
+		t.Errorf("Capture buffer grew beyond its limits: %v, %v", len(b.head), len(b.tail))
+	}
+}
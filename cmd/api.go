@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IMQS/scheduler"
+)
+
+// The JSON API, which is used by our monitoring and ops tooling
+
+func registerApiHandlers() {
+	http.HandleFunc("GET /scheduler/commands", authorize(scheduler.PermissionRead, handleListCommands))
+	http.HandleFunc("GET /scheduler/commands/{name}", authorize(scheduler.PermissionRead, handleGetCommand))
+	http.HandleFunc("POST /scheduler/commands/{name}/run", authorize(scheduler.PermissionTrigger, handleRunCommand))
+	http.HandleFunc("POST /scheduler/commands/{name}/cancel", authorize(scheduler.PermissionCancel, handleCancelCommand))
+	http.HandleFunc("POST /scheduler/commands/{name}/enable", authorize(scheduler.PermissionAdmin, handleSetEnabled("enable")))
+	http.HandleFunc("POST /scheduler/commands/{name}/disable", authorize(scheduler.PermissionAdmin, handleSetEnabled("disable")))
+	http.HandleFunc("POST /scheduler/commands/{name}/reset", authorize(scheduler.PermissionAdmin, handleSetEnabled("reset")))
+	http.HandleFunc("GET /scheduler/runs", authorize(scheduler.PermissionRead, handleListRuns))
+	http.HandleFunc("GET /scheduler/runs/{id}", authorize(scheduler.PermissionRead, handleGetRun))
+	http.HandleFunc("GET /scheduler/runs/{id}/output", authorize(scheduler.PermissionRead, handleGetRunOutput))
+	http.HandleFunc("GET /scheduler/metrics", authorize(scheduler.PermissionRead, handleMetrics))
+	http.HandleFunc("GET /scheduler/events", authorize(scheduler.PermissionRead, handleEvents))
+	http.HandleFunc("GET /scheduler/ui", handleDashboard)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorf("Error writing JSON response: %v", err)
+	}
+}
+
+// Find a command by name. The caller must hold commandsLock, or be the main loop.
+func findCommand(name string) *scheduler.Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// List every command, along with its live state.
+// We release commandsLock before writing, so that a slow client can't hold up the main loop.
+func handleListCommands(w http.ResponseWriter, r *http.Request) {
+	commandsLock.RLock()
+	now := time.Now()
+	list := []scheduler.CommandStatus{}
+	for _, c := range commands {
+		list = append(list, c.Status(now))
+	}
+	commandsLock.RUnlock()
+	writeJson(w, list)
+}
+
+func handleGetCommand(w http.ResponseWriter, r *http.Request) {
+	commandsLock.RLock()
+	var status *scheduler.CommandStatus
+	if c := findCommand(r.PathValue("name")); c != nil {
+		s := c.Status(time.Now())
+		status = &s
+	}
+	commandsLock.RUnlock()
+	if status == nil {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, status)
+}
+
+// A request to run a command, which is sent to the main loop
+type triggerRequest struct {
+	command   string
+	queue     bool
+	variables map[string]string // Overlay the configured variables, for this run only
+	result    chan triggerResult
+}
+
+type triggerResult struct {
+	RunID  string `json:",omitempty"` // The ID of the run, if it started
+	Queued bool   // True if the command was queued, because it or its pool was busy
+	status int
+	err    string
+}
+
+// How long we wait for the main loop to accept a trigger. The main loop only blocks
+// while it reloads the config, so this should never be reached. Tests shorten it.
+var triggerTimeout = 10 * time.Second
+
+// Run a command now. Returns 404 if the command does not exist, and 409 if the command
+// is already running, or its pool is busy. If the query parameter 'queue' is true, then
+// instead of 409, the command is queued to run when it and its pool are free, and 202 is returned.
+// Variables for this run may be supplied as query parameters named var.NAME, such as
+// ?var.LOCATOR_SRC=c:\imqsvar\imports\batch1, or as a JSON object in the body, such as
+// {"LOCATOR_SRC": "c:\\imqsvar\\imports\\batch1"}. Only the variables that the command
+// allows (AllowVariables) may be supplied. Any others are rejected with 403.
+func handleRunCommand(w http.ResponseWriter, r *http.Request) {
+	handleTrigger(w, r, r.PathValue("name"))
+}
+
+// Our original trigger URL, /scheduler/?command=NAME. The command may also be POSTed as a form.
+func handleLegacyTrigger(w http.ResponseWriter, r *http.Request) {
+	commandName := r.FormValue("command")
+	if len(commandName) == 0 {
+		http.Error(w, "Command name missing from request", http.StatusBadRequest)
+		return
+	}
+	handleTrigger(w, r, commandName)
+}
+
+func handleTrigger(w http.ResponseWriter, r *http.Request, command string) {
+	queue, _ := strconv.ParseBool(r.URL.Query().Get("queue"))
+	variables, err := requestVariables(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &triggerRequest{
+		command:   command,
+		queue:     queue,
+		variables: variables,
+		result:    make(chan triggerResult, 1),
+	}
+	select {
+	case triggerChan <- req:
+	case <-time.After(triggerTimeout):
+		http.Error(w, "Scheduler is busy", http.StatusServiceUnavailable)
+		return
+	}
+	res := <-req.result
+	if res.err != "" {
+		http.Error(w, res.err, res.status)
+		return
+	}
+	logger.Infof("Run of '%v' requested by %v", command, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logger.Errorf("Error writing JSON response: %v", err)
+	}
+}
+
+// Query parameters with this prefix are variables. Other query parameters, such as a
+// cache buster that was added by a proxy, are ignored.
+const variableParamPrefix = "var."
+
+// Read the variables of a trigger request, from the query string and the JSON body
+func requestVariables(r *http.Request) (map[string]string, error) {
+	variables := map[string]string{}
+	for k, v := range r.URL.Query() {
+		if name, ok := strings.CutPrefix(k, variableParamPrefix); ok && name != "" && len(v) != 0 {
+			variables[name] = v[0]
+		}
+	}
+	if r.Body != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		body := map[string]string{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&body); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("Invalid JSON body: %v", err)
+		}
+		for k, v := range body {
+			variables[k] = v
+		}
+	}
+	return variables, nil
+}
+
+// Run f on the main loop, and wait for it to finish. Returns false if the main loop is too busy.
+func onMainLoop(f func()) bool {
+	done := make(chan bool)
+	select {
+	case mainLoopChan <- func() {
+		f()
+		close(done)
+	}:
+	case <-time.After(triggerTimeout):
+		return false
+	}
+	<-done
+	return true
+}
+
+// Enable or disable a command, regardless of the config. The override is kept in the state file,
+// so it survives a restart. 'reset' removes the override, so that the config applies again.
+func handleSetEnabled(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var status *scheduler.CommandStatus
+		ok := onMainLoop(func() {
+			c := findCommand(r.PathValue("name"))
+			if c == nil {
+				return
+			}
+			// 'reset' removes the override
+			enabled := action == "enable"
+			var override *bool
+			if action != "reset" {
+				override = &enabled
+			}
+			if err := state.SetEnabled(c.Name, override); err != nil {
+				logger.Errorf("Error saving state file %v: %v", state.Filename, err)
+			}
+			logger.Infof("%v of '%v' requested by %v", action, c.Name, r.RemoteAddr)
+			// HTTP handlers read Enabled while holding the read lock
+			commandsLock.Lock()
+			setEnabled(c, effectiveEnabled(c.Name), "Changed from the API")
+			commandsLock.Unlock()
+			s := c.Status(time.Now())
+			status = &s
+		})
+		if !ok {
+			http.Error(w, "Scheduler is busy", http.StatusServiceUnavailable)
+		} else if status == nil {
+			http.Error(w, "Command not found", http.StatusNotFound)
+		} else {
+			writeJson(w, status)
+		}
+	}
+}
+
+// Kill a running command. Returns 409 if the command is not running.
+func handleCancelCommand(w http.ResponseWriter, r *http.Request) {
+	commandsLock.RLock()
+	c := findCommand(r.PathValue("name"))
+	found, cancelled := c != nil, false
+	var status scheduler.CommandStatus
+	if found {
+		cancelled = c.Cancel()
+		status = c.Status(time.Now())
+	}
+	commandsLock.RUnlock()
+	if !found {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Command is not running", http.StatusConflict)
+		return
+	}
+	logger.Infof("Cancel of '%v' requested by %v", status.Name, r.RemoteAddr)
+	writeJson(w, status)
+}
+
+// List recent runs, newest first. The optional query parameters are 'command' and 'limit'.
+func handleListRuns(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	commandsLock.RLock()
+	h := history
+	commandsLock.RUnlock()
+	writeJson(w, h.Recent(r.FormValue("command"), limit))
+}
+
+func handleGetRun(w http.ResponseWriter, r *http.Request) {
+	commandsLock.RLock()
+	h := history
+	commandsLock.RUnlock()
+	run := h.Get(r.PathValue("id"))
+	if run == nil {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, run)
+}
+
+// Serve the complete output of a run. This also works while the run is still busy.
+func handleGetRunOutput(w http.ResponseWriter, r *http.Request) {
+	commandsLock.RLock()
+	store := outputStore
+	commandsLock.RUnlock()
+	if store == nil {
+		http.Error(w, "Output files are disabled", http.StatusNotFound)
+		return
+	}
+	f, err := store.Open(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Output not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, f)
+}
+
+// Metrics for Prometheus. We render them before writing, so that a slow scraper can't hold commandsLock.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	commandsLock.RLock()
+	metrics.Write(buf, commands, time.Now())
+	commandsLock.RUnlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Errorf("Error writing metrics: %v", err)
+	}
+}
+
+// Send a keep-alive comment this often, so that proxies don't close an idle event stream
+const eventKeepAlive = 30 * time.Second
+
+// Stream events as they happen, as Server-Sent Events. A client that reconnects with
+// the Last-Event-ID header receives the recent events that it missed.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	afterID := int64(-1)
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		if id, err := strconv.ParseInt(last, 10, 64); err == nil {
+			afterID = id
+		}
+	}
+	ch := events.Subscribe(afterID)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-ch:
+			raw, err := json.Marshal(e)
+			if err != nil {
+				logger.Errorf("Error encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, raw); err != nil {
+				return
+			}
+		case <-time.After(eventKeepAlive):
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
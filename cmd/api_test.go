@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/scheduler"
+)
+
+func TestRequestVariables(t *testing.T) {
+	r := httptest.NewRequest("POST", "/scheduler/commands/import/run?queue=1&_=123&var.LOCATOR_SRC=batch1&var.=x", nil)
+	vars, err := requestVariables(r)
+	if err != nil || len(vars) != 1 || vars["LOCATOR_SRC"] != "batch1" {
+		t.Errorf("Query variables incorrect: %v, %v", vars, err)
+	}
+
+	r = httptest.NewRequest("POST", "/scheduler/commands/import/run?var.A=query", strings.NewReader(`{"B": "body"}`))
+	r.Header.Set("Content-Type", "application/json")
+	vars, err = requestVariables(r)
+	if err != nil || len(vars) != 2 || vars["A"] != "query" || vars["B"] != "body" {
+		t.Errorf("Body variables incorrect: %v, %v", vars, err)
+	}
+}
+
+// Serve the main loop until the test finishes
+func serveMainLoop(t *testing.T) {
+	stop := make(chan bool)
+	t.Cleanup(func() { close(stop) })
+	go func() {
+		for {
+			select {
+			case req := <-triggerChan:
+				req.result <- runCommandNow(req)
+			case f := <-mainLoopChan:
+				f()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func setEnabledRequest(action, name string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/scheduler/commands/"+name+"/"+action, nil)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	handleSetEnabled(action)(w, r)
+	return w
+}
+
+func TestSetEnabled(t *testing.T) {
+	logger = log.NewTesting(t)
+	var err error
+	if state, err = scheduler.LoadStateFile(filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Fatalf("Failed to create state file: %v", err)
+	}
+	config = scheduler.Config{Enabled: []string{"backup"}}
+	cfg := scheduler.ConfigCommand{Name: "backup", Command: "backup.exe", Interval: "1h", Timeout: "1h"}
+	commands = []*scheduler.Command{buildCommandFromConfig(cfg, effectiveEnabled("backup"))}
+	backup := commands[0]
+	if !backup.Enabled {
+		t.Fatalf("Config must enable the command")
+	}
+	serveMainLoop(t)
+	published := events.Subscribe(-1)
+	defer events.Unsubscribe(published)
+
+	// Disabling from the API beats the config, including when the config is reloaded
+	if w := setEnabledRequest("disable", "backup"); w.Code != http.StatusOK || backup.Enabled {
+		t.Errorf("Disable failed: %v %v", w.Code, w.Body.String())
+	}
+	if e := <-published; e.Type != scheduler.EventDisabled || e.Command != "backup" {
+		t.Errorf("Expected disabled event, but got %+v", e)
+	}
+	if effectiveEnabled("backup") || buildCommandFromConfig(cfg, effectiveEnabled("backup")).Enabled {
+		t.Errorf("Override must beat the config")
+	}
+	if reloaded, _ := scheduler.LoadStateFile(state.Filename); reloaded.EnabledOverrides()["backup"] != false || len(reloaded.EnabledOverrides()) != 1 {
+		t.Errorf("Override was not saved: %v", reloaded.EnabledOverrides())
+	}
+
+	// Reset restores the config
+	if w := setEnabledRequest("reset", "backup"); w.Code != http.StatusOK || !backup.Enabled {
+		t.Errorf("Reset failed: %v %v", w.Code, w.Body.String())
+	}
+	if e := <-published; e.Type != scheduler.EventEnabled {
+		t.Errorf("Expected enabled event, but got %+v", e)
+	}
+	if len(state.EnabledOverrides()) != 0 {
+		t.Errorf("Reset must remove the override")
+	}
+
+	// Enabling a command that the config disables
+	config.Disabled = []string{"backup"}
+	if effectiveEnabled("backup") {
+		t.Errorf("Config must disable the command")
+	}
+	if w := setEnabledRequest("enable", "backup"); w.Code != http.StatusOK || !backup.Enabled || !effectiveEnabled("backup") {
+		t.Errorf("Enable failed: %v %v", w.Code, w.Body.String())
+	}
+
+	if w := setEnabledRequest("disable", "nonexistent"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown command, but got %v", w.Code)
+	}
+}
+
+func TestSetEnabledBusy(t *testing.T) {
+	logger = log.NewTesting(t)
+	saved := triggerTimeout
+	triggerTimeout = 10 * time.Millisecond
+	defer func() { triggerTimeout = saved }()
+	// Nothing is serving the main loop
+	if w := setEnabledRequest("disable", "backup"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when the main loop is busy, but got %v", w.Code)
+	}
+}
+
+func runRequest(name, query string) (*httptest.ResponseRecorder, triggerResult) {
+	r := httptest.NewRequest("POST", "/scheduler/commands/"+name+"/run"+query, nil)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	handleRunCommand(w, r)
+	res := triggerResult{}
+	if w.Code < 300 {
+		json.NewDecoder(w.Body).Decode(&res)
+	}
+	return w, res
+}
+
+func TestRunCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	logger = log.NewTesting(t)
+	config = scheduler.Config{}
+	poolLimits = scheduler.PoolLimits{}
+	started := make(chan string, 1)
+	backup := &scheduler.Command{Name: "backup", Pool: "db", Exec: "sleep", Params: []string{"10"}, Timeout: time.Minute}
+	backup.OnStart = func(c *scheduler.Command, run *scheduler.RunRecord) {
+		started <- run.ID
+	}
+	vacuum := &scheduler.Command{Name: "vacuum", Pool: "db", Exec: "sleep", Params: []string{"10"}, Timeout: time.Minute}
+	commands = []*scheduler.Command{backup, vacuum}
+	serveMainLoop(t)
+
+	if w, _ := runRequest("nonexistent", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown command, but got %v", w.Code)
+	}
+
+	w, res := runRequest("backup", "")
+	if w.Code != http.StatusOK || res.RunID == "" || res.Queued {
+		t.Fatalf("Run failed: %v %v", w.Code, w.Body.String())
+	}
+	t.Cleanup(func() {
+		backup.Cancel()
+		for backup.IsRunning() {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	if id := <-started; id != res.RunID {
+		t.Errorf("Expected run ID %v, but got %v", id, res.RunID)
+	}
+
+	if w, _ := runRequest("backup", ""); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "already running") {
+		t.Errorf("Expected 409 when the command is running, but got %v %v", w.Code, w.Body.String())
+	}
+	if w, _ := runRequest("vacuum", ""); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Pool 'db' is busy") {
+		t.Errorf("Expected 409 when the pool is busy, but got %v %v", w.Code, w.Body.String())
+	}
+	if vacuum.Status(time.Now()).Queued {
+		t.Errorf("Command must not be queued without ?queue=1")
+	}
+
+	w, res = runRequest("vacuum", "?queue=1")
+	if w.Code != http.StatusAccepted || !res.Queued || res.RunID != "" || vacuum.IsRunning() {
+		t.Errorf("Expected 202 and Queued, but got %v %v", w.Code, w.Body.String())
+	}
+	if !vacuum.Status(time.Now()).Queued {
+		t.Errorf("Command was not queued")
+	}
+}
+
+func legacyRequest(body, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/scheduler/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	authorize(scheduler.PermissionTrigger, handleLegacyTrigger)(w, r)
+	return w
+}
+
+func TestLegacyTrigger(t *testing.T) {
+	logger = log.NewTesting(t)
+	config = scheduler.Config{}
+	commands = []*scheduler.Command{{Name: "vacuum", Pool: "db"}}
+	authorizer = nil
+	defer func() { authorizer = nil }()
+	serveMainLoop(t)
+
+	// The command may be POSTed as a form. 404 shows that the name reached the main loop.
+	if w := legacyRequest("command=import", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown command in form body, but got %v %v", w.Code, w.Body.String())
+	}
+	if w := legacyRequest("", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 when the command is missing, but got %v", w.Code)
+	}
+
+	// The command in the form body is the one that is authorized
+	authorizer = &scheduler.Authorizer{Tokens: []*scheduler.ApiToken{
+		{Name: "jobs", Secret: "jobs-secret", Permissions: []scheduler.Permission{scheduler.PermissionTrigger}, Commands: []string{"import"}},
+	}}
+	if w := legacyRequest("command=vacuum", "Bearer jobs-secret"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a command that the token may not run, but got %v", w.Code)
+	}
+	if w := legacyRequest("command=import", "Bearer jobs-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a command that the token may run, but got %v %v", w.Code, w.Body.String())
+	}
+	// A signed request's body is still readable after it has been verified
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := scheduler.SignRequest("jobs-secret", "POST", "/scheduler/", timestamp, []byte("command=import"))
+	if w := legacyRequest("command=import", "IMQS-HMAC jobs:"+timestamp+":"+signature); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a signed request, but got %v %v", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/IMQS/scheduler"
+)
+
+// Build the authorizer from the config. Tokens with errors are skipped, so a mistake in
+// the config locks that token out, instead of granting it more than was intended.
+// The caller must hold commandsLock.
+func buildAuthorizer() {
+	a := &scheduler.Authorizer{}
+	for _, t := range config.Http.Tokens {
+		if t.Name == "" || t.Secret == "" {
+			logger.Errorf("API token '%v' must have a Name and a Secret", t.Name)
+			continue
+		}
+		token := &scheduler.ApiToken{
+			Name:     t.Name,
+			Secret:   t.Secret,
+			Commands: t.Commands,
+			Pools:    t.Pools,
+		}
+		for _, p := range t.Permissions {
+			if perm, err := scheduler.ParsePermission(p); err != nil {
+				logger.Errorf("API token '%v': %v", t.Name, err)
+			} else {
+				token.Permissions = append(token.Permissions, perm)
+			}
+		}
+		a.Tokens = append(a.Tokens, token)
+	}
+	authorizer = a
+}
+
+// Wrap a handler, so that it only runs if the request's token has the given permission.
+// For trigger and cancel, the command is taken from the path (or the 'command' parameter of
+// our original trigger URL), because a token may be limited to certain commands or pools.
+func authorize(perm scheduler.Permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		commandsLock.RLock()
+		a := authorizer
+		commandsLock.RUnlock()
+
+		if !a.Enabled() {
+			handler(w, r)
+			return
+		}
+		token, err := a.Authenticate(r, time.Now())
+		if err != nil {
+			logger.Warnf("Rejected API request %v %v from %v: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// The 'command' parameter may be in a form body, so we only read it after Authenticate
+		// has read the body of a signed request. The form is parsed once, so the handler sees
+		// the same value as we do.
+		commandName := r.PathValue("name")
+		if commandName == "" {
+			commandName = r.FormValue("command")
+		}
+		pool := ""
+		commandsLock.RLock()
+		if c := findCommand(commandName); c != nil {
+			pool = c.Pool
+		}
+		commandsLock.RUnlock()
+		if !token.Allows(perm, commandName, pool) {
+			logger.Warnf("API token '%v' may not %v '%v'", token.Name, perm, commandName)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
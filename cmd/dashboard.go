@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The dashboard is a single page, which uses our JSON API. It has no data of its own,
+// so it is served without authentication. The user enters a token into the page, if needed.
+//
+//go:embed dashboard.html
+var dashboardHtml []byte
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHtml)
+}
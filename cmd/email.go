@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/IMQS/scheduler"
+)
+
+const defaultDigestInterval = time.Hour
+
+// Configure the mailer from the Email section of the config. The mailer itself is only created once,
+// so that its digests and throttling survive a config reload. A rule with errors is skipped, and the
+// rest still work. The caller must hold commandsLock.
+func buildMailer() {
+	if mailer == nil {
+		mailer = scheduler.NewMailer(logger)
+	}
+	c := config.Email
+	settings := scheduler.SmtpSettings{
+		Host:     c.Host,
+		Port:     c.Port,
+		TLS:      c.TLS,
+		Username: c.Username,
+		Password: c.Password,
+		From:     c.From,
+	}
+	switch settings.TLS {
+	case "":
+		settings.TLS = scheduler.SmtpStartTls
+	case scheduler.SmtpPlain, scheduler.SmtpStartTls, scheduler.SmtpTls:
+	default:
+		logger.Errorf("Invalid Email TLS '%v'. Must be none, starttls, or tls. Using starttls.", c.TLS)
+		settings.TLS = scheduler.SmtpStartTls
+	}
+	if settings.Host != "" && settings.From == "" {
+		logger.Errorf("Email needs a From address. No mail will be sent.")
+		settings.Host = ""
+	}
+	// net/smtp refuses to send a password over an unencrypted connection, except to localhost,
+	// so we rather say so now than fail on every mail.
+	isLocalhost := settings.Host == "localhost" || settings.Host == "127.0.0.1" || settings.Host == "::1"
+	if settings.Host != "" && settings.Username != "" && settings.TLS == scheduler.SmtpPlain && !isLocalhost {
+		logger.Errorf("Email has a Username, but TLS is none. A password can't be sent without encryption. No mail will be sent.")
+		settings.Host = ""
+	}
+
+	interval := defaultDigestInterval
+	if c.DigestInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(c.DigestInterval); err != nil {
+			logger.Errorf("Error parsing Email DigestInterval: %v", err)
+			interval = defaultDigestInterval
+		}
+	}
+
+	rules := []*scheduler.EmailRule{}
+	for i, r := range c.Rules {
+		rule := &scheduler.EmailRule{
+			To:       r.To,
+			Commands: r.Commands,
+			Pools:    r.Pools,
+		}
+		for _, on := range r.On {
+			cond, err := scheduler.ParseNotifyCondition(on)
+			if err == nil && cond != scheduler.NotifyFailure && cond != scheduler.NotifyTimeout {
+				err = fmt.Errorf("Mail can only be sent on failure or timeout, not '%v'", on)
+			}
+			if err != nil {
+				logger.Errorf("Error in Email rule %v: %v", i+1, err)
+			} else {
+				rule.On = append(rule.On, cond)
+			}
+		}
+		if len(r.On) == 0 {
+			rule.On = []scheduler.NotifyCondition{scheduler.NotifyFailure, scheduler.NotifyTimeout}
+		}
+		if len(rule.To) == 0 || len(rule.On) == 0 {
+			logger.Errorf("Email rule %v needs at least one address in To, and one condition in On", i+1)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	mailer.Configure(settings, rules, interval)
+}
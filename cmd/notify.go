@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/IMQS/scheduler"
+)
+
+const (
+	defaultWebhookAttempts   = 3
+	defaultWebhookRetryDelay = 10 * time.Second
+)
+
+// Build the notifier from the global webhooks, and the webhooks of each task.
+// A webhook with errors is skipped, and the rest still work. The caller must hold commandsLock.
+func buildNotifier() {
+	rules := []*scheduler.WebhookRule{}
+	for _, w := range config.Webhooks {
+		if rule := buildWebhookRule(w, "global"); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	for _, cmd := range config.Commands {
+		for _, w := range cmd.Webhooks {
+			if rule := buildWebhookRule(w, "task '"+cmd.Name+"'"); rule != nil {
+				rule.Commands = []string{cmd.Name}
+				rules = append(rules, rule)
+			}
+		}
+	}
+	notifier = scheduler.NewNotifier(logger, rules)
+}
+
+func buildWebhookRule(w scheduler.ConfigWebhook, owner string) *scheduler.WebhookRule {
+	rule := &scheduler.WebhookRule{
+		Commands:    w.Commands,
+		URLs:        w.URLs,
+		ContentType: w.ContentType,
+		Headers:     w.Headers,
+		MaxAttempts: w.MaxAttempts,
+		RetryDelay:  defaultWebhookRetryDelay,
+	}
+	if rule.MaxAttempts <= 0 {
+		rule.MaxAttempts = defaultWebhookAttempts
+	}
+	for _, on := range w.On {
+		if c, err := scheduler.ParseNotifyCondition(on); err != nil {
+			logger.Errorf("Error in %v webhook: %v", owner, err)
+		} else {
+			rule.On = append(rule.On, c)
+		}
+	}
+	if w.RetryDelay != "" {
+		var err error
+		if rule.RetryDelay, err = time.ParseDuration(w.RetryDelay); err != nil {
+			logger.Errorf("Error parsing RetryDelay of %v webhook: %v", owner, err)
+			rule.RetryDelay = defaultWebhookRetryDelay
+		}
+	}
+	if w.Body != "" {
+		var err error
+		if rule.Body, err = scheduler.ParseWebhookTemplate(w.Body); err != nil {
+			logger.Errorf("Error parsing Body of %v webhook: %v", owner, err)
+			return nil
+		}
+	}
+	if len(rule.URLs) == 0 || len(rule.On) == 0 {
+		logger.Errorf("The %v webhook needs at least one URL and one condition in On", owner)
+		return nil
+	}
+	return rule
+}
@@ -20,6 +20,8 @@ a configuration file.
 
 Our philosophy here is "never die". So if we encounter errors, we soldier on. We must never
 die, because then the server is bricked, and humans need to go sort out all bricked servers.
+This applies to the jobs that we run too. A job that produces endless output must not be
+able to exhaust our memory, so we only keep the beginning and the end of its output.
 */
 package main
 
@@ -30,6 +32,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/IMQS/cli"
@@ -39,13 +42,39 @@ import (
 )
 
 var commands []*scheduler.Command
+var poolLimits scheduler.PoolLimits
+var wakeChan = make(chan bool, 1)
+var triggerChan = make(chan *triggerRequest)
+var mainLoopChan = make(chan func())
+var commandsLock sync.RWMutex // Held by the main loop while it modifies 'commands' or 'config', and by HTTP handlers that read them
 var logger *log.Logger
 var config scheduler.Config
+var state *scheduler.StateFile // Replaced by loadConfig if the state file changes. Command goroutines must read it while holding commandsLock.
+var history *scheduler.History
+var outputStore *scheduler.OutputStore
+var outputStores = map[string]*scheduler.OutputStore{} // Every store that we've built, by directory. Only used by buildOutputStore.
+var authorizer *scheduler.Authorizer
+var metrics = scheduler.NewMetrics()
+var events = scheduler.NewEventBus()
+var notifier *scheduler.Notifier
+var mailer *scheduler.Mailer
+var waitingForPool = map[string]bool{}     // Commands that we've reported as waiting for their pool. Only used by the main loop.
+var missedWindows = map[string]time.Time{} // The last missed window that we reported for each command. Only used by the main loop.
+var watchingSince = map[string]time.Time{} // When each command was added, or last enabled. We don't report windows that it missed before then. Only used by the main loop.
 var imqsHttpPort int
 
 const (
 	taskConfUpdate    = "ImqsConf Update"
 	schedulerHttpPort = ":2014"
+	defaultStateFile  = "c:/imqsvar/scheduler/state.json"
+	defaultHistory    = "c:/imqsvar/scheduler/history.jsonl"
+	defaultMaxRuns    = 5000
+	defaultMaxRunAge  = 30 * 24 * time.Hour
+	maxDispatchSleep  = time.Minute
+	defaultOutputDir  = "c:/imqsvar/logs/scheduler-runs"
+	defaultMaxOutput  = 1024 * 1024
+	defaultMaxOutputs = 200
+	defaultOutputAge  = 30 * 24 * time.Hour
 )
 
 func main() {
@@ -92,14 +121,86 @@ func setDefaultVariables() {
 	}
 }
 
+// Parse a start time such as "3h30m" into hours and minutes since midnight
+func parseStartTime(startTime string) (int, int, error) {
+	start_time, err := time.ParseDuration(startTime)
+	if err != nil {
+		return 0, 0, err
+	}
+	hours := int(start_time / time.Hour)
+	start_time -= time.Duration(hours) * time.Hour
+	minutes := int(start_time / time.Minute)
+	return hours, minutes, nil
+}
+
+// Weekly and monthly tasks are built as cron schedules. Returns nil on failure.
+func buildCalendarSchedule(cmd scheduler.ConfigCommand) *scheduler.CronSchedule {
+	if strings.TrimSpace(cmd.Weekday) != "" && strings.TrimSpace(cmd.DayOfMonth) != "" {
+		logger.Errorf("Task '%v' may have a Weekday or a DayOfMonth, but not both", cmd.Name)
+		return nil
+	}
+	hours, minutes, err := parseStartTime(cmd.StartTime)
+	if err != nil {
+		logger.Errorf("Error parsing start time for task '%v': %v", cmd.Name, err)
+		return nil
+	}
+	var cron *scheduler.CronSchedule
+	if strings.TrimSpace(cmd.Weekday) != "" {
+		var day time.Weekday
+		if day, err = scheduler.ParseWeekday(cmd.Weekday); err == nil {
+			cron, err = scheduler.WeeklySchedule(day, hours, minutes)
+		}
+	} else {
+		var day int
+		if day, err = scheduler.ParseDayOfMonth(cmd.DayOfMonth); err == nil {
+			cron, err = scheduler.MonthlySchedule(day, hours, minutes)
+		}
+	}
+	if err != nil {
+		logger.Errorf("Error building schedule for task '%v': %v", cmd.Name, err)
+		return nil
+	}
+	return cron
+}
+
 func buildCommandFromConfig(cmd scheduler.ConfigCommand, isEnabled bool) *scheduler.Command {
+	// A task that runs after other tasks has no schedule of its own.
+	// Otherwise, a cron expression, or a weekly or monthly schedule, takes precedence over Interval.
+	// If a cron, weekly or monthly schedule is invalid, then the task is disabled, and gets no
+	// schedule at all. Falling back to an interval would run it at the wrong times.
+	isDependent := len(cmd.After) != 0
+	invalidSchedule := false
+	var cron *scheduler.CronSchedule
+	if isDependent {
+		// There is no schedule to parse
+	} else if strings.TrimSpace(cmd.Cron) != "" {
+		var err error
+		cron, err = scheduler.ParseCron(cmd.Cron)
+		if err != nil {
+			logger.Errorf("Error parsing cron expression for task '%s': %v", cmd.Name, err)
+			invalidSchedule = true
+		}
+	} else if strings.TrimSpace(cmd.Weekday) != "" || strings.TrimSpace(cmd.DayOfMonth) != "" {
+		cron = buildCalendarSchedule(cmd)
+		invalidSchedule = cron == nil
+	}
+	if invalidSchedule {
+		logger.Errorf("Task '%v' is disabled, because its schedule is invalid", cmd.Name)
+		isEnabled = false
+	}
+
 	// Convert time from string into time.Duration format
-	haveInterval := true
-	interval, err := time.ParseDuration(cmd.Interval)
-	if err != nil {
-		haveInterval = false
-		logger.Errorf("Error parsing interval for task '%s': %v", cmd.Name, err)
-		interval = 1 * time.Hour
+	haveInterval := false
+	var interval time.Duration
+	if cron == nil && !isDependent && !invalidSchedule {
+		var err error
+		haveInterval = true
+		interval, err = time.ParseDuration(cmd.Interval)
+		if err != nil {
+			haveInterval = false
+			logger.Errorf("Error parsing interval for task '%s': %v", cmd.Name, err)
+			interval = 1 * time.Hour
+		}
 	}
 	timeout, err := time.ParseDuration(cmd.Timeout)
 	if err != nil {
@@ -108,10 +209,10 @@ func buildCommandFromConfig(cmd scheduler.ConfigCommand, isEnabled bool) *schedu
 	}
 
 	// Sanity checks
-	if interval < (5 * time.Second) {
+	if haveInterval && interval < (5*time.Second) {
 		logger.Errorf("Invalid interval of less than 5 seconds for task '%v'", cmd.Name)
 	}
-	if interval > (24 * time.Hour) {
+	if haveInterval && interval > (24*time.Hour) {
 		logger.Errorf("Invalid interval of more than 24 hours for task '%v'", cmd.Name)
 	}
 	if timeout < (5 * time.Second) {
@@ -123,28 +224,83 @@ func buildCommandFromConfig(cmd scheduler.ConfigCommand, isEnabled bool) *schedu
 	if len(strings.TrimSpace(cmd.Name)) == 0 {
 		logger.Errorf("Invalid empty task name for command '%v'", cmd.Command)
 	}
-	if len(strings.TrimSpace(cmd.Command)) == 0 {
+
+	// A full command line takes precedence over Command and Params
+	executable := cmd.Command
+	params := cmd.Params
+	if strings.TrimSpace(cmd.CommandLine) != "" {
+		args, err := scheduler.SplitCommandLine(cmd.CommandLine)
+		if err != nil {
+			logger.Errorf("Error parsing command line for task '%v': %v", cmd.Name, err)
+		} else if len(args) != 0 {
+			executable = args[0]
+			params = args[1:]
+		}
+	}
+	if len(strings.TrimSpace(executable)) == 0 {
 		logger.Errorf("Invalid empty command for task '%v'", cmd.Name)
 	}
 
+	var gracePeriod time.Duration
+	if cmd.GracePeriod != "" {
+		if gracePeriod, err = time.ParseDuration(cmd.GracePeriod); err != nil {
+			logger.Errorf("Error parsing grace period for task '%v': %v", cmd.Name, err)
+		}
+	}
+
+	retry := scheduler.RetryPolicy{
+		MaxAttempts:    cmd.Retry.MaxAttempts,
+		Multiplier:     cmd.Retry.Multiplier,
+		ExitCodes:      cmd.Retry.ExitCodes,
+		OnTimeout:      cmd.Retry.OnTimeout,
+		OnStartFailure: cmd.Retry.OnStartFailure,
+	}
+	if retry.MaxAttempts > 0 {
+		retry.InitialDelay, err = time.ParseDuration(cmd.Retry.InitialDelay)
+		if err != nil {
+			logger.Errorf("Error parsing retry delay for task '%v': %v", cmd.Name, err)
+			retry.InitialDelay = 5 * time.Minute
+		}
+	}
+
+	exitCodes := map[int]scheduler.Outcome{}
+	for code, outcome := range cmd.ExitCodes {
+		if o, err := scheduler.ParseExitOutcome(outcome); err != nil {
+			logger.Errorf("Error parsing outcome of exit code %v for task '%v': %v", code, cmd.Name, err)
+		} else {
+			exitCodes[code] = o
+		}
+	}
+
 	newCommand := &scheduler.Command{
-		Name:        cmd.Name,
-		Pool:        cmd.Pool,
-		Interval:    interval,
-		Timeout:     timeout,
-		Exec:        cmd.Command,
-		Params:      cmd.Params,
-		Enabled:     isEnabled,
-		DisableLogs: cmd.DisableLogs,
+		Name:           cmd.Name,
+		Pool:           cmd.Pool,
+		Interval:       interval,
+		Cron:           cron,
+		Timeout:        timeout,
+		GracePeriod:    gracePeriod,
+		Exec:           executable,
+		Params:         params,
+		Enabled:        isEnabled,
+		DisableLogs:    cmd.DisableLogs,
+		ExitCodes:      exitCodes,
+		Retry:          retry,
+		AllowVariables: cmd.AllowVariables,
+		After:          cmd.After,
+		OnSuccess:      cmd.OnSuccess,
+		OnFailure:      cmd.OnFailure,
+		Env:            cmd.Env,
+		ClearEnv:       cmd.InheritEnv != nil && !*cmd.InheritEnv,
+		WorkingDir:     cmd.WorkingDir,
+		Output:         outputStore,
+		OnStart:        onCommandStart,
+		OnFinish:       onCommandFinish,
 	}
 
 	// Only try parsing start time when interval value is valid and this is daily task
 	if haveInterval && interval == 24*time.Hour {
-		start_time, err := time.ParseDuration(cmd.StartTime)
+		hours, minutes, err := parseStartTime(cmd.StartTime)
 		if err == nil {
-			hours := int(start_time / time.Hour)
-			start_time -= time.Duration(hours) * time.Hour
-			minutes := int(start_time / time.Minute)
 			newCommand.SetStartTime(hours, minutes)
 		} else {
 			logger.Errorf("Error parsing start time for daily task '%v': %v", cmd.Name, err)
@@ -154,6 +310,242 @@ func buildCommandFromConfig(cmd scheduler.ConfigCommand, isEnabled bool) *schedu
 	return newCommand
 }
 
+// Build the store for the output files of runs, or update its limits. We keep one store per
+// directory for the life of the process, so that runs which started before and after a config
+// change prune the directory under the same lock.
+func buildOutputStore() {
+	if config.Output.Disable {
+		outputStore = nil
+		return
+	}
+	dir := config.Output.Dir
+	if dir == "" {
+		dir = defaultOutputDir
+	}
+	maxBytes := config.Output.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxOutput
+	}
+	maxFiles := config.Output.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultMaxOutputs
+	}
+	maxAge := defaultOutputAge
+	if config.Output.MaxAge != "" {
+		if age, err := time.ParseDuration(config.Output.MaxAge); err != nil {
+			logger.Errorf("Error parsing Output.MaxAge '%v': %v", config.Output.MaxAge, err)
+		} else {
+			maxAge = age
+		}
+	}
+	store := outputStores[dir]
+	if store == nil {
+		store = &scheduler.OutputStore{Dir: dir}
+		outputStores[dir] = store
+	}
+	store.SetLimits(maxBytes, maxFiles, maxAge)
+	outputStore = store
+}
+
+func buildPoolLimits() {
+	poolLimits = scheduler.PoolLimits{}
+	for _, p := range config.Pools {
+		if p.MaxConcurrent < 1 {
+			logger.Errorf("Invalid MaxConcurrent of %v for pool '%v'", p.MaxConcurrent, p.Name)
+			continue
+		}
+		poolLimits[p.Name] = p.MaxConcurrent
+	}
+}
+
+// Load the state file, unless we've already loaded it. The caller must hold commandsLock.
+func loadState() {
+	filename := config.StateFile
+	if filename == "" {
+		filename = defaultStateFile
+	}
+	if state != nil && state.Filename == filename {
+		return
+	}
+	var err error
+	state, err = scheduler.LoadStateFile(filename)
+	if err != nil {
+		logger.Errorf("Error loading state file %v: %v", filename, err)
+	}
+}
+
+// Open the history file, or update its retention limits if it's already open
+func loadHistory() {
+	filename := config.History.Filename
+	if filename == "" {
+		filename = defaultHistory
+	}
+	maxRuns := config.History.MaxRuns
+	if maxRuns <= 0 {
+		maxRuns = defaultMaxRuns
+	}
+	maxAge := defaultMaxRunAge
+	if config.History.MaxAge != "" {
+		if age, err := time.ParseDuration(config.History.MaxAge); err != nil {
+			logger.Errorf("Error parsing history MaxAge: %v", err)
+		} else {
+			maxAge = age
+		}
+	}
+	if history != nil && history.Filename == filename {
+		history.SetRetention(maxRuns, maxAge)
+		return
+	}
+	var err error
+	history, err = scheduler.OpenHistory(filename, maxRuns, maxAge)
+	if err != nil {
+		logger.Errorf("Error loading history file %v: %v", filename, err)
+	}
+}
+
+func saveCommandState(c *scheduler.Command) {
+	// This runs on the command's goroutine, while the main loop may be loading a new state file
+	commandsLock.RLock()
+	s := state
+	commandsLock.RUnlock()
+	if err := s.Record(c); err != nil {
+		logger.Errorf("Error saving state file %v: %v", s.Filename, err)
+	}
+}
+
+func onCommandStart(c *scheduler.Command, run *scheduler.RunRecord) {
+	saveCommandState(c)
+	// loadConfig may change the pool while we run
+	commandsLock.RLock()
+	pool := c.Pool
+	commandsLock.RUnlock()
+	events.Publish(scheduler.Event{
+		Type:    scheduler.EventStarted,
+		Command: c.Name,
+		Pool:    pool,
+		RunID:   run.ID,
+		Trigger: run.Trigger,
+	})
+}
+
+func onCommandFinish(c *scheduler.Command, run *scheduler.RunRecord) {
+	saveCommandState(c)
+	metrics.RecordRun(run)
+	// The main loop may replace these, and change the pool, while we run
+	commandsLock.RLock()
+	h, n, m := history, notifier, mailer
+	pool := c.Pool
+	commandsLock.RUnlock()
+	var previous *scheduler.RunRecord
+	if recent := h.Recent(c.Name, 1); len(recent) != 0 {
+		previous = &recent[0]
+	}
+	n.RunFinished(run, previous)
+	m.RunFinished(run, pool)
+	if run.Outcome == scheduler.OutcomeTimeout {
+		events.Publish(scheduler.Event{
+			Type:    scheduler.EventTimedOut,
+			Command: c.Name,
+			Pool:    pool,
+			RunID:   run.ID,
+			Message: "Process was " + string(run.Termination),
+		})
+	}
+	events.Publish(scheduler.Event{
+		Type:     scheduler.EventFinished,
+		Command:  c.Name,
+		Pool:     pool,
+		RunID:    run.ID,
+		Trigger:  run.Trigger,
+		Outcome:  run.Outcome,
+		Duration: run.Duration,
+		Message:  run.Error,
+	})
+	if err := h.Add(run); err != nil {
+		logger.Errorf("Error saving history file %v: %v", h.Filename, err)
+	}
+	// The command's pool now has space, and other commands may have been queued
+	wakeDispatcher()
+}
+
+// Wake the main loop, so that it launches any commands that have become runnable. This never blocks.
+func wakeDispatcher() {
+	select {
+	case wakeChan <- true:
+	default:
+	}
+}
+
+// Launch every command that is ready to run, and return how long the main loop
+// may sleep before another command becomes due.
+func dispatch() time.Duration {
+	now := time.Now()
+	for _, c := range scheduler.RunnableCommands(commands, poolLimits, now) {
+		c.Run(logger, config.Variables, scheduler.TriggerSchedule)
+	}
+	reportWaitingCommands(now)
+	sleep := maxDispatchSleep
+	if next := scheduler.NextWakeup(commands, now); !next.IsZero() && next.Sub(now) < sleep {
+		sleep = next.Sub(now)
+	}
+	return sleep
+}
+
+// Publish events for commands that have started waiting for their pool, or that missed their start window.
+// Each of these is only reported once.
+func reportWaitingCommands(now time.Time) {
+	for _, c := range commands {
+		waiting := !c.IsRunning() && c.MustRun(now)
+		if waiting && !waitingForPool[c.Name] {
+			events.Publish(scheduler.Event{
+				Type:    scheduler.EventPoolBusy,
+				Command: c.Name,
+				Pool:    c.Pool,
+			})
+		}
+		waitingForPool[c.Name] = waiting
+
+		if missed := c.MissedWindow(now, watchingSince[c.Name]); !missed.IsZero() && !missed.Equal(missedWindows[c.Name]) {
+			missedWindows[c.Name] = missed
+			logger.Warnf("'%v' did not start within the window of its scheduled time %v, so it was skipped", c.Name, missed.Format("2006-01-02 15:04"))
+			events.Publish(scheduler.Event{
+				Type:    scheduler.EventWindowMissed,
+				Command: c.Name,
+				Pool:    c.Pool,
+				Message: "Scheduled for " + missed.Format(time.RFC3339),
+			})
+			notifier.WindowMissed(c.Name, missed)
+		}
+	}
+}
+
+// Returns true if the command is enabled by the config, or by an override from the API.
+// The caller must hold commandsLock, or be the main loop.
+func effectiveEnabled(name string) bool {
+	if enabled, ok := state.EnabledOverrides()[name]; ok {
+		return enabled
+	}
+	enabledMap := map[string]bool{}
+	toggleEnabled(enabledMap, config.Enabled, config.Disabled)
+	return enabledMap[name]
+}
+
+// Enable or disable the command, and publish an event if that changes anything.
+// The caller must hold commandsLock for writing.
+func setEnabled(c *scheduler.Command, enabled bool, reason string) {
+	if enabled && !c.Enabled {
+		watchingSince[c.Name] = time.Now()
+	}
+	if c.Enabled != enabled {
+		eventType := scheduler.EventDisabled
+		if enabled {
+			eventType = scheduler.EventEnabled
+		}
+		events.Publish(scheduler.Event{Type: eventType, Command: c.Name, Pool: c.Pool, Message: reason})
+	}
+	c.Enabled = enabled
+}
+
 func toggleEnabled(enabledMap map[string]bool, enabled, disabled []string) {
 	for _, e := range enabled {
 		enabledMap[e] = true
@@ -164,11 +556,15 @@ func toggleEnabled(enabledMap map[string]bool, enabled, disabled []string) {
 }
 
 func loadConfig(mainConfigPath, auxConfigPath string) {
+	commandsLock.Lock()
+	defer commandsLock.Unlock()
+
 	config = scheduler.Config{}
 	setDefaultVariables()
 
 	if err := config.LoadFile(mainConfigPath); err != nil {
 		logger.Errorf("Error loading config file %v: %v", mainConfigPath, err)
+		metrics.RecordConfigError()
 		return
 	}
 
@@ -177,11 +573,22 @@ func loadConfig(mainConfigPath, auxConfigPath string) {
 		var overlayConfig scheduler.Config
 		if err := overlayConfig.LoadFile(auxConfigPath); err != nil {
 			logger.Errorf("Error loading aux config file %v: %v", auxConfigPath, err)
+			metrics.RecordConfigError()
 		} else {
 			for key, value := range overlayConfig.Variables {
 				config.Variables[key] = value
 			}
 
+			// Tokens are usually specific to a site, so the aux config may add them
+			config.Http.Tokens = append(config.Http.Tokens, overlayConfig.Http.Tokens...)
+			if overlayConfig.Http.Listen != "" {
+				config.Http.Listen = overlayConfig.Http.Listen
+			}
+			// So is the mail server
+			if overlayConfig.Email.Host != "" {
+				config.Email = overlayConfig.Email
+			}
+
 			for _, cmd := range overlayConfig.Enabled {
 				config.SetCommandEnabled(cmd, true)
 			}
@@ -209,32 +616,49 @@ func loadConfig(mainConfigPath, auxConfigPath string) {
 		}
 	}
 
-	// Build map of enabled jobs
-	enabledMap := map[string]bool{}
-	toggleEnabled(enabledMap, config.Enabled, config.Disabled)
+	loadState()
+	loadHistory()
+	buildOutputStore()
+	buildPoolLimits()
+	buildAuthorizer()
+	buildNotifier()
+	buildMailer()
 
 	// Add or overwrite to commands array
 	// Don't clobber things like 'lastRun' and 'isRunningAtomic' for existing commands
 	for _, t := range config.Commands {
-		newCommand := buildCommandFromConfig(t, enabledMap[t.Name])
+		newCommand := buildCommandFromConfig(t, effectiveEnabled(t.Name))
 
 		foundCommand := false
 		for i, c := range commands {
 			if newCommand.Name == c.Name {
 				foundCommand = true
 				commands[i].Pool = newCommand.Pool
-				commands[i].Enabled = newCommand.Enabled
+				setEnabled(commands[i], newCommand.Enabled, "")
 				commands[i].StartTime = newCommand.StartTime
 				commands[i].Interval = newCommand.Interval
+				commands[i].Cron = newCommand.Cron
 				commands[i].Timeout = newCommand.Timeout
+				commands[i].GracePeriod = newCommand.GracePeriod
 				commands[i].Exec = newCommand.Exec
 				commands[i].Params = newCommand.Params
-				commands[i].Enabled = enabledMap[t.Name]
+				commands[i].ExitCodes = newCommand.ExitCodes
+				commands[i].Retry = newCommand.Retry
+				commands[i].AllowVariables = newCommand.AllowVariables
+				commands[i].After = newCommand.After
+				commands[i].OnSuccess = newCommand.OnSuccess
+				commands[i].OnFailure = newCommand.OnFailure
+				commands[i].Env = newCommand.Env
+				commands[i].ClearEnv = newCommand.ClearEnv
+				commands[i].WorkingDir = newCommand.WorkingDir
+				commands[i].Output = newCommand.Output
 				break
 			}
 		}
 
 		if !foundCommand {
+			watchingSince[newCommand.Name] = time.Now()
+			state.Restore(newCommand)
 			commands = append(commands, newCommand)
 		}
 	}
@@ -254,20 +678,35 @@ func cmdEnabledList() string {
 	}
 }
 
-// This method handles the http request used to start a job.
-func runCommandNow(commandName string) {
-	// Look for the Importer command in the list of commands
-	var command *scheduler.Command
-	for _, cmd := range commands {
-		if cmd.Name == commandName {
-			command = cmd
-		}
+// Run a command that was requested over HTTP. This is only called from the main loop,
+// which is the only goroutine that launches commands, so nothing can start between our
+// check of the pool and the launch.
+func runCommandNow(req *triggerRequest) triggerResult {
+	c := findCommand(req.command)
+	if c == nil {
+		return triggerResult{status: http.StatusNotFound, err: "Command not found"}
 	}
-	if len(command.Name) == 0 {
-		logger.Errorf("Error cannot find requested command provided in url")
-		return
+	variables, err := c.OverlayVariables(config.Variables, req.variables)
+	if err != nil {
+		return triggerResult{status: http.StatusForbidden, err: err.Error()}
+	}
+	busy := ""
+	if c.IsRunning() {
+		busy = "Command is already running"
+	} else if !scheduler.PoolHasCapacity(commands, poolLimits, c.Pool) {
+		busy = "Pool '" + c.Pool + "' is busy"
+	}
+	if busy != "" {
+		if !req.queue {
+			return triggerResult{status: http.StatusConflict, err: busy}
+		}
+		if !c.Queue(scheduler.TriggerHttp, time.Now(), req.variables) {
+			return triggerResult{status: http.StatusConflict, err: "Command is already queued with different variables"}
+		}
+		logger.Infof("Queued '%v' (%v)", c.Name, busy)
+		return triggerResult{status: http.StatusAccepted, Queued: true}
 	}
-	command.Run(logger, config.Variables)
+	return triggerResult{status: http.StatusOK, RunID: c.Run(logger, variables, scheduler.TriggerHttp)}
 }
 
 func execApp(name string, args []string, options cli.OptionSet) int {
@@ -293,47 +732,58 @@ func run(options cli.OptionSet) {
 		loadConfig(options["c"], options["auxconfig"])
 		if config.HashSignature() != lastConfigHash {
 			lastConfigHash = config.HashSignature()
+			metrics.RecordConfigReload()
+			commandsLock.Lock()
+			if err := scheduler.ResolveDependencies(commands); err != nil {
+				logger.Errorf("%v", err)
+				metrics.RecordConfigError()
+			}
+			commandsLock.Unlock()
 			logger.Infof("Variables: %v", config.Variables)
 			logger.Infof("Enabled: %v", cmdEnabledList())
+			events.Publish(scheduler.Event{Type: scheduler.EventConfigReloaded})
 		}
 	}
 	reloadConfig()
 
 	logger.Infof("Scheduler starting")
+	scheduler.StartReaper(logger)
 
-	tickChan := time.NewTicker(time.Second * 5).C
-	httpChan := make(chan string)
-
+	configTickChan := time.NewTicker(time.Second * 5).C
 	http.HandleFunc("/scheduler/ping", func(w http.ResponseWriter, r *http.Request) {
 		timestamp := time.Now().Unix()
 		fmt.Fprintf(w, `{"Timestamp":%v}`, timestamp)
 	})
 
-	http.HandleFunc("/scheduler/", func(w http.ResponseWriter, r *http.Request) {
-		commandName := r.FormValue("command")
-		if len(commandName) == 0 {
-			http.Error(w, "Command name missing from request", http.StatusBadRequest)
-			return
-		}
-		httpChan <- commandName
-		w.WriteHeader(http.StatusOK)
-	})
-	go http.ListenAndServe(schedulerHttpPort, nil)
+	http.HandleFunc("/scheduler/", authorize(scheduler.PermissionTrigger, handleLegacyTrigger))
+	registerApiHandlers()
+	listen := config.Http.Listen
+	if listen == "" {
+		listen = schedulerHttpPort
+	}
+	if !authorizer.Enabled() {
+		logger.Warnf("No API tokens are configured, so anybody who can reach %v can run and cancel commands", listen)
+	}
+	go func() {
+		logger.Errorf("HTTP server stopped: %v", http.ListenAndServe(listen, nil))
+	}()
 
+	// We dispatch after every event. Besides the config reload, we wake up when a command
+	// finishes, or when the next command is due.
+	sleep := time.Duration(0)
 	for {
 		select {
-		case commandName := <-httpChan:
+		case req := <-triggerChan:
+			req.result <- runCommandNow(req)
+		case f := <-mainLoopChan:
+			f()
+		case <-configTickChan:
 			{
-				runCommandNow(commandName)
-			}
-		case <-tickChan:
-			{
-				next := scheduler.NextRunnable(commands, time.Now())
-				if next != nil {
-					next.Run(logger, config.Variables)
-				}
 				reloadConfig()
 			}
+		case <-wakeChan:
+		case <-time.After(sleep):
 		}
+		sleep = dispatch()
 	}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+	"github.com/IMQS/scheduler"
+)
+
+// Returns true if the command would run at any time during the next few days
+func runsWithin(c *scheduler.Command, from time.Time, days int) bool {
+	for now := from; now.Before(from.AddDate(0, 0, days)); now = now.Add(10 * time.Minute) {
+		if c.MustRun(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInvalidCronIsDisabled(t *testing.T) {
+	logger = log.NewTesting(t)
+	from := time.Date(2015, 07, 15, 0, 0, 0, 0, time.Local)
+
+	c := buildCommandFromConfig(scheduler.ConfigCommand{Name: "backup", Command: "backup.exe", Timeout: "1h", Cron: "30 2 * * MON-FRY"}, true)
+	if c.Enabled {
+		t.Errorf("Task with an invalid cron expression must be disabled")
+	}
+	if runsWithin(c, from, 3) {
+		t.Errorf("Task with an invalid cron expression must never run")
+	}
+	// Not even if somebody enables it from the API
+	c.Enabled = true
+	if runsWithin(c, from, 3) {
+		t.Errorf("Enabled task with an invalid cron expression must never run")
+	}
+
+	valid := buildCommandFromConfig(scheduler.ConfigCommand{Name: "backup", Command: "backup.exe", Timeout: "1h", Cron: "30 2 * * MON-FRI"}, true)
+	if !valid.Enabled || !runsWithin(valid, from, 3) {
+		t.Errorf("Task with a valid cron expression must run")
+	}
+}
+
+func TestInvalidCalendarScheduleIsDisabled(t *testing.T) {
+	logger = log.NewTesting(t)
+	from := time.Date(2015, 07, 15, 0, 0, 0, 0, time.Local)
+
+	cases := []scheduler.ConfigCommand{
+		{Weekday: "Frieday", StartTime: "2h"},
+		{DayOfMonth: "32", StartTime: "2h"},
+		{DayOfMonth: "1", StartTime: "2 o'clock"},
+		{DayOfMonth: "1"},
+		{Weekday: "Friday", DayOfMonth: "1", StartTime: "2h"},
+	}
+	for i, cfg := range cases {
+		cfg.Name = "archive"
+		cfg.Command = "archive.exe"
+		cfg.Timeout = "1h"
+		c := buildCommandFromConfig(cfg, true)
+		c.Enabled = true
+		if runsWithin(c, from, 40) {
+			t.Errorf("Case %v: task with an invalid schedule must never run", i)
+		}
+	}
+
+	monthly := buildCommandFromConfig(scheduler.ConfigCommand{Name: "archive", Command: "archive.exe", Timeout: "1h", DayOfMonth: "1", StartTime: "2h"}, true)
+	if !monthly.Enabled || !runsWithin(monthly, from, 40) {
+		t.Errorf("Task with a valid monthly schedule must run")
+	}
+}
@@ -1,10 +1,13 @@
 package scheduler
 
 import (
-	"bytes"
+	"fmt"
+	"io"
 	"os/exec"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,10 +27,17 @@ import (
 // They must start within 2 hours of their start time, or they don't start at all.
 // We assume that our scheduler service will never be down for more than a few minutes,
 // so it's very unlikely that we miss our 2 hour window.
+// Tasks with a cron schedule get the same window, measured from each time that the
+// cron expression fires. Weekly and monthly tasks are built as cron schedules, so they
+// are protected in the same way.
 const dailyCommandWindow = 2 * time.Hour
 
+// How long we wait for a process to exit after we've killed it, so that we have all of its output
+const stoppedOutputWait = 5 * time.Second
+
 /* A scheduled task
-Every scheduled task belongs to a pool. At most one job from a pool may run at any one time.
+Every scheduled task belongs to a pool. By default, at most one job from a pool may run at any one time.
+A pool can be given a higher limit with PoolLimits.
 */
 type Command struct {
 	Name            string
@@ -35,12 +45,39 @@ type Command struct {
 	Enabled         bool
 	StartTime       time.Time // Year,Month,Day is ignored. Only hour,minute,second (since midnight) is important
 	Interval        time.Duration
+	Cron            *CronSchedule // If not nil, then Interval and StartTime are ignored, and the task runs whenever the cron expression fires
 	Timeout         time.Duration
+	GracePeriod     time.Duration // On timeout, ask the process to terminate, and wait this long before killing it. Zero means kill immediately.
 	Exec            string
-	Params          []string
-	DisableLogs     bool // If true, then never emit stdout or stderr to our logs. This was created to silence output-heavy jobs such as tile cache seeding, because they flood our log aggregator (Datadog)
-	lastRun         time.Time
+	Params          []string          // Each element is exactly one argument. Variables are substituted into each one individually.
+	Env             map[string]string // Extra environment variables. Variables (eg !LOCATOR_SRC) are substituted into the values.
+	ClearEnv        bool              // If true, then the process does not inherit the scheduler's environment. It only gets Env.
+	WorkingDir      string            // If not empty, the process starts in this directory. Variables are substituted into it.
+	AllowVariables  []string          // Variables that may be overridden by whoever triggers the command over HTTP
+	Output          *OutputStore      // If not nil, then the stdout and stderr of every run are written to a file in this store
+	DisableLogs     bool              // If true, then never emit stdout or stderr to our logs. This was created to silence output-heavy jobs such as tile cache seeding, because they flood our log aggregator (Datadog)
+	ExitCodes       map[int]Outcome   // Overrides the outcome of specific exit codes. For example, exit code 2 could mean "nothing to do", which is a success.
+	Retry           RetryPolicy
+	After           []string                         // If not empty, then the task has no schedule of its own, and runs after all of these commands have succeeded
+	OnSuccess       []string                         // Commands to queue when this command succeeds
+	OnFailure       []string                         // Commands to queue when this command fails
+	OnStart         func(c *Command, run *RunRecord) // If not nil, called from the command's goroutine after it starts
+	OnFinish        func(c *Command, run *RunRecord) // If not nil, called from the command's goroutine after it finishes, and its pool has been released
+	lastRun         time.Time                        // Written by the command's goroutine. Read it with LastRun(), and likewise for lastFinish and lastSuccess.
+	lastFinish      time.Time
+	lastSuccess     time.Time
+	after           []*Command        // Resolved from After by ResolveDependencies
+	onSuccess       []*Command        // Resolved from OnSuccess
+	onFailure       []*Command        // Resolved from OnFailure
+	retryCount      int               // Number of retries that have been scheduled since the last run that didn't need a retry
+	retryAt         time.Time         // If not zero, then a retry is pending at this time
+	retryVariables  map[string]string // The variables of the run that failed, which the retry runs with
 	isRunningAtomic int32
+	runLock         sync.Mutex    // Guards lastRun, lastFinish, lastSuccess, retryCount, retryAt, retryVariables, cancelChan, queued, queuedAt, and queuedVariables
+	cancelChan      chan struct{} // Closed by Cancel(). Nil when the command is not running.
+	queued          Trigger       // If not empty, then the command must run as soon as possible
+	queuedAt        time.Time
+	queuedVariables map[string]string // Variables that overlay the normal variables, for the queued run
 }
 
 type SortCommands struct {
@@ -51,25 +88,13 @@ type SortCommands struct {
 func (v SortCommands) Len() int      { return len(v.List) }
 func (v SortCommands) Swap(i, j int) { v.List[i], v.List[j] = v.List[j], v.List[i] }
 func (v SortCommands) Less(i, j int) bool {
-	// A daily task is always "more overdue" (ie more important) than a non-daily task
-	if v.List[i].isDaily() != v.List[j].isDaily() {
-		return v.List[j].isDaily()
+	// A daily (or cron) task is always "more overdue" (ie more important) than a regular interval task
+	if v.List[i].hasStartWindow() != v.List[j].hasStartWindow() {
+		return v.List[j].hasStartWindow()
 	}
 	return v.List[i].timeOverdue(v.Now) < v.List[j].timeOverdue(v.Now)
 }
 
-// Split a command-line into the executable and the parameters
-func parse_exec(cmd string) (string, string) {
-	if cmd[0] == uint8('"') {
-		close := strings.Index(cmd[1:], "\"") - 1
-		if close > 0 {
-			return cmd[1:close], cmd[close+2:]
-		}
-	}
-	firstSpace := strings.Index(cmd, " ")
-	return cmd[0:firstSpace], cmd[firstSpace+1:]
-}
-
 func substitute_variables(params string, variables map[string]string) string {
 	for key, value := range variables {
 		params = strings.Replace(params, "!"+key, value, -1)
@@ -77,6 +102,24 @@ func substitute_variables(params string, variables map[string]string) string {
 	return params
 }
 
+// Returns a copy of variables, with overrides applied on top.
+// Only the variables in AllowVariables may be overridden.
+func (c *Command) OverlayVariables(variables, overrides map[string]string) (map[string]string, error) {
+	result := makeCopyOfVariables(variables)
+	keys := []string{}
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !slices.Contains(c.AllowVariables, k) {
+			return nil, fmt.Errorf("Variable '%v' may not be overridden for command '%v'", k, c.Name)
+		}
+		result[k] = overrides[k]
+	}
+	return result, nil
+}
+
 func makeCopyOfVariables(variables map[string]string) map[string]string {
 	copy := map[string]string{}
 	for k, v := range variables {
@@ -89,13 +132,54 @@ func (c *Command) MustRun(now time.Time) bool {
 	if atomic.LoadInt32(&c.isRunningAtomic) != 0 {
 		return false
 	}
-	if c.isDaily() {
-		return c.Enabled && ((now.Sub(c.mostRecentStartTime(now)) < dailyCommandWindow) && (now.Sub(c.lastRun) > dailyCommandWindow))
+	if c.retryDue(now) && !c.inStartWindow(now) {
+		// The retry was held up (eg by a busy pool) until the start window closed
+		c.cancelRetry()
+	}
+	queued := c.queuedTrigger()
+	if queued == TriggerHttp || (c.Enabled && (c.retryDue(now) || queued != "")) {
+		return true
+	}
+	if c.isDependent() {
+		return c.Enabled && !c.dependenciesReady().IsZero()
+	} else if c.Cron != nil {
+		next := c.nextCronRun(now)
+		return c.Enabled && !next.IsZero() && !next.After(now)
+	} else if c.isDaily() {
+		return c.Enabled && ((now.Sub(c.mostRecentStartTime(now)) < dailyCommandWindow) && (now.Sub(c.LastRun()) > dailyCommandWindow))
+	} else if !c.hasSchedule() {
+		return false
 	} else {
-		return c.Enabled && (now.Sub(c.lastRun) >= c.Interval)
+		return c.Enabled && (now.Sub(c.LastRun()) >= c.Interval)
 	}
 }
 
+// Returns true if the command is busy running
+func (c *Command) IsRunning() bool {
+	return atomic.LoadInt32(&c.isRunningAtomic) != 0
+}
+
+// Returns the time when the command was last started
+func (c *Command) LastRun() time.Time {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.lastRun
+}
+
+// Returns the time when the command last finished
+func (c *Command) LastFinish() time.Time {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.lastFinish
+}
+
+// Returns the time when the command last finished successfully
+func (c *Command) LastSuccess() time.Time {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.lastSuccess
+}
+
 func (c *Command) SetStartTime(hour, minute int) {
 	if !c.isDaily() {
 		panic("StartTime is only applicable to daily tasks")
@@ -104,7 +188,60 @@ func (c *Command) SetStartTime(hour, minute int) {
 }
 
 func (c *Command) isDaily() bool {
-	return c.Interval == 24*time.Hour
+	return c.Cron == nil && c.Interval == 24*time.Hour
+}
+
+// A command without a schedule only runs when it is queued. This is how we neutralize a
+// command whose schedule could not be parsed.
+func (c *Command) hasSchedule() bool {
+	return c.isDependent() || c.Cron != nil || c.Interval > 0
+}
+
+// Daily and cron tasks must start within dailyCommandWindow of their scheduled time
+func (c *Command) hasStartWindow() bool {
+	return c.isDaily() || c.Cron != nil
+}
+
+// Find the first time that the cron expression fires after our last run.
+// Activations that are older than dailyCommandWindow are forgotten.
+func (c *Command) nextCronRun(now time.Time) time.Time {
+	from := c.LastRun()
+	if windowStart := now.Add(-dailyCommandWindow); from.Before(windowStart) {
+		from = windowStart
+	}
+	return c.Cron.Next(from)
+}
+
+// If the command missed the start window of a scheduled run, then return the scheduled time
+// of that run. Otherwise, return the zero time. Only daily and cron tasks have a start window.
+// We only look at the first window that opened after the command last ran, so this keeps
+// returning the same time until the command runs again. A task that is held up for hours
+// (eg by a busy pool) therefore misses one window, no matter how many times its schedule fired.
+// Callers must only report each missed time once.
+// 'since' is the time from which the caller has been watching the command while it was enabled.
+// A window that opened before then is not reported, because the command may well have had no
+// chance to run in it. For example, the scheduler was not running yet, or the command was new.
+func (c *Command) MissedWindow(now, since time.Time) time.Time {
+	if !c.Enabled || c.isDependent() || !c.hasStartWindow() || c.IsRunning() {
+		return time.Time{}
+	}
+	from := c.LastRun()
+	if from.Before(since) {
+		from = since
+	}
+	var scheduled time.Time
+	if c.isDaily() {
+		scheduled = c.mostRecentStartTime(from).Add(24 * time.Hour)
+		if !scheduled.After(from) {
+			scheduled = scheduled.Add(24 * time.Hour)
+		}
+	} else {
+		scheduled = c.Cron.Next(from)
+	}
+	if scheduled.IsZero() || now.Sub(scheduled) < dailyCommandWindow {
+		return time.Time{}
+	}
+	return scheduled
 }
 
 // Find the most recent point in history that crossed StartTime
@@ -123,19 +260,63 @@ func (c *Command) mostRecentStartTime(now time.Time) time.Time {
 }
 
 func (c *Command) timeOverdue(now time.Time) time.Duration {
-	if c.isDaily() {
-		if !c.lastRun.IsZero() {
-			return now.Sub(c.lastRun) - c.Interval
+	if queuedAt := c.queuedTime(); !queuedAt.IsZero() {
+		return now.Sub(queuedAt)
+	} else if c.retryDue(now) {
+		return now.Sub(c.retryTime())
+	} else if c.isDependent() {
+		ready := c.dependenciesReady()
+		if ready.IsZero() {
+			return 0
+		}
+		return now.Sub(ready)
+	} else if c.Cron != nil {
+		next := c.nextCronRun(now)
+		if next.IsZero() {
+			return 0
+		}
+		return now.Sub(next)
+	} else if c.isDaily() {
+		if lastRun := c.LastRun(); !lastRun.IsZero() {
+			return now.Sub(lastRun) - c.Interval
 		} else {
 			return now.Sub(c.mostRecentStartTime(now))
 		}
+	} else if !c.hasSchedule() {
+		return 0
 	} else {
-		return now.Sub(c.lastRun) - c.Interval
+		return now.Sub(c.LastRun()) - c.Interval
 	}
 }
 
-// Launch the command in it's own goroutine.
-func (c *Command) Run(logger *log.Logger, variables map[string]string) {
+// Copy the config that a run reads after it has been launched. loadConfig changes these
+// fields on the main loop while the command may be running, so the command's goroutine
+// only reads them from this copy.
+func (c *Command) runConfig() *Command {
+	return &Command{
+		Name:        c.Name,
+		StartTime:   c.StartTime,
+		Interval:    c.Interval,
+		Cron:        c.Cron,
+		Timeout:     c.Timeout,
+		GracePeriod: c.GracePeriod,
+		Exec:        c.Exec,
+		Params:      c.Params,
+		Env:         c.Env,
+		ClearEnv:    c.ClearEnv,
+		WorkingDir:  c.WorkingDir,
+		Output:      c.Output,
+		DisableLogs: c.DisableLogs,
+		ExitCodes:   c.ExitCodes,
+		Retry:       c.Retry,
+		onSuccess:   c.onSuccess,
+		onFailure:   c.onFailure,
+	}
+}
+
+// Launch the command in it's own goroutine. Returns the ID of the run.
+// This must be called from the goroutine that owns the command's config (ie the main loop).
+func (c *Command) Run(logger *log.Logger, variables map[string]string, trigger Trigger) string {
 	// Because we're launching our own goroutine, we make a copy of 'variables', so
 	// that the caller doesn't need to remember to do that.
 	variables = makeCopyOfVariables(variables)
@@ -144,20 +325,96 @@ func (c *Command) Run(logger *log.Logger, variables map[string]string) {
 	// If we only toggled isRunningAtomic = 1 from inside the goroutine that we launch,
 	// then we'd be at risk of the function that called Run() trying to launch the same job twice.
 	atomic.StoreInt32(&c.isRunningAtomic, 1)
+	// The scheduler launches the queued run, if there is one. Somebody else's queued run,
+	// and its variables, must survive a direct run from HTTP, so it stays in the queue.
+	if trigger == TriggerSchedule {
+		if queued, overrides := c.takeQueued(); queued != "" {
+			trigger = queued
+			for k, v := range overrides {
+				variables[k] = v
+			}
+		}
+	}
+	cfg := c.runConfig()
+	cancelc := make(chan struct{})
+	c.runLock.Lock()
+	c.cancelChan = cancelc
+	c.runLock.Unlock()
+	run := &RunRecord{
+		Command:  c.Name,
+		Trigger:  trigger,
+		Started:  time.Now(),
+		ExitCode: -1,
+		Attempt:  1,
+	}
+	run.ID = newRunID(run.Started)
+	id := run.ID
 	go func() {
-		defer atomic.StoreInt32(&c.isRunningAtomic, 0)
-		c.lastRun = time.Now()
-		params := strings.Fields(substitute_variables(strings.Join(c.Params, " "), variables))
-		logger.Infof("Running '%v' %v (%v)", c.Name, c.Exec, params)
-		cmd := exec.Command(c.Exec, params...)
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Start()
+		c.runLock.Lock()
+		retryAt, retryCount, retryVariables := c.retryAt, c.retryCount, c.retryVariables
+		c.runLock.Unlock()
+		if !retryAt.IsZero() {
+			run.Attempt = retryCount + 1
+			if trigger == TriggerSchedule && c.retryDue(run.Started) {
+				run.Trigger = TriggerRetry
+				variables = retryVariables
+			}
+		}
+		defer func() {
+			run.Finished = time.Now()
+			run.Duration = run.Finished.Sub(run.Started).Seconds()
+			c.runLock.Lock()
+			c.lastFinish = run.Finished
+			if run.Outcome.Succeeded() {
+				c.lastSuccess = run.Finished
+			}
+			c.runLock.Unlock()
+			queueFollowers(run, cfg.onSuccess, cfg.onFailure)
+			if retryAt, retryCount := c.scheduleRetry(cfg, run, variables); !retryAt.IsZero() {
+				logger.Infof("Retrying '%v' at %v (retry %v of %v)", c.Name, retryAt.Format("15:04:05"), retryCount, cfg.Retry.MaxAttempts)
+			}
+			// Release the command (and its pool) before calling OnFinish, so that whoever
+			// is notified by OnFinish sees that the command is no longer running.
+			c.runLock.Lock()
+			c.cancelChan = nil
+			c.runLock.Unlock()
+			atomic.StoreInt32(&c.isRunningAtomic, 0)
+			if c.OnFinish != nil {
+				c.OnFinish(c, run)
+			}
+		}()
+		c.runLock.Lock()
+		c.lastRun = run.Started
+		c.runLock.Unlock()
+		if c.OnStart != nil {
+			c.OnStart(c, run)
+		}
+		params := substituteParams(cfg.Params, variables)
+		logger.Infof("Running '%v' %v %q", c.Name, cfg.Exec, params)
+		cmd := exec.Command(cfg.Exec, params...)
+		cmd.Dir = substitute_variables(cfg.WorkingDir, variables)
+		cmd.Env = buildEnvironment(cfg.Env, !cfg.ClearEnv, variables)
+		stdout := newCaptureBuffer(captureHeadLimit, captureTailLimit)
+		stderr := newCaptureBuffer(captureHeadLimit, captureTailLimit)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if cfg.Output != nil {
+			if out, err := cfg.Output.Create(run.ID); err != nil {
+				logger.Errorf("Failed to create output file for %v: %v", c.Name, err)
+			} else {
+				defer out.Close()
+				run.OutputFile = out.Filename
+				cmd.Stdout = io.MultiWriter(stdout, out)
+				cmd.Stderr = io.MultiWriter(stderr, out)
+			}
+		}
+		setProcessAttributes(cmd)
+		err := startChild(cmd)
 		if err != nil {
+			run.Outcome = OutcomeStartFailure
+			run.Error = err.Error()
 			logger.Errorf("Failed to start %v: %v", c.Name, err)
-			if !c.DisableLogs {
+			if !cfg.DisableLogs {
 				logger.Infof("stdout: " + stdout.String())
 				logger.Infof("stderr: " + stderr.String())
 			}
@@ -165,20 +422,56 @@ func (c *Command) Run(logger *log.Logger, variables map[string]string) {
 			// wait or timeout
 			donec := make(chan error, 1)
 			go func() {
-				donec <- cmd.Wait()
+				donec <- waitChild(cmd)
 			}()
+			// After we've stopped the process, we wait a little for it to exit, so that all of
+			// its output has been copied. We don't wait longer, so that the pool is released quickly.
+			waitForOutput := func() {
+				select {
+				case <-donec:
+				case <-time.After(stoppedOutputWait):
+				}
+			}
 			select {
-			case <-time.After(c.Timeout):
-				logger.Errorf("%v timed out after %v seconds.", c.Name, c.Timeout)
-				if !killProcessTree(cmd.Process.Pid) {
-					logger.Errorf("Failed to kill process.")
+			case <-time.After(cfg.Timeout):
+				run.Outcome = OutcomeTimeout
+				logger.Errorf("%v timed out after %v seconds.", c.Name, cfg.Timeout)
+				run.Termination = stopProcess(logger, c.Name, cmd.Process.Pid, cfg.GracePeriod, donec)
+				if run.Termination == TerminationGraceful {
+					recordExitStatus(run, cmd.ProcessState, nil)
+				} else {
+					waitForOutput()
 				}
-			case <-donec:
+				run.Stdout = truncateOutput(stdout.String(), historyOutputLimit)
+				run.Stderr = truncateOutput(stderr.String(), historyOutputLimit)
+			case <-cancelc:
+				run.Outcome = OutcomeCancelled
+				logger.Infof("%v cancelled", c.Name)
+				run.Termination = stopProcess(logger, c.Name, cmd.Process.Pid, 0, donec)
+				waitForOutput()
+				run.Stdout = truncateOutput(stdout.String(), historyOutputLimit)
+				run.Stderr = truncateOutput(stderr.String(), historyOutputLimit)
+			case err := <-donec:
 				// Success logs are just spammy.
 				//logger.Infof("Success %v", c.Name)
-				if !cmd.ProcessState.Success() {
-					logger.Errorf("Finished with error: %v", c.Name)
-					if !c.DisableLogs {
+				recordExitStatus(run, cmd.ProcessState, err)
+				run.Stdout = truncateOutput(stdout.String(), historyOutputLimit)
+				run.Stderr = truncateOutput(stderr.String(), historyOutputLimit)
+				if run.Signal != "" {
+					// A process that was killed by somebody else never counts as a success
+					run.Outcome = OutcomeFailure
+				} else {
+					run.Outcome = cfg.classifyExit(run.ExitCode)
+				}
+				if run.Error != "" {
+					logger.Errorf("Error running %v: %v", c.Name, run.Error)
+				}
+				switch run.Outcome {
+				case OutcomeWarning:
+					logger.Warnf("%v finished with a warning (%v)", c.Name, describeExit(run))
+				case OutcomeFailure:
+					logger.Errorf("Finished with error: %v (%v)", c.Name, describeExit(run))
+					if !cfg.DisableLogs {
 						logger.Infof("stdout: " + stdout.String())
 						logger.Infof("stderr: " + stderr.String())
 					}
@@ -186,22 +479,69 @@ func (c *Command) Run(logger *log.Logger, variables map[string]string) {
 			}
 		}
 	}()
+	return id
+}
+
+// Cancel the command, if it is running.
+// The process tree is killed, and the run is recorded as cancelled.
+// Returns false if the command is not running.
+func (c *Command) Cancel() bool {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.cancelChan == nil {
+		return false
+	}
+	close(c.cancelChan)
+	c.cancelChan = nil
+	return true
 }
 
 func offsetFromStartOfDay(t time.Time) time.Duration {
 	return time.Second * time.Duration(t.Hour()*3600+t.Minute()*60+t.Second())
 }
 
+// The maximum number of commands that may run concurrently in each pool.
+// Pools that are not listed here have a limit of 1.
+type PoolLimits map[string]int
+
+func (p PoolLimits) limit(pool string) int {
+	if n, ok := p[pool]; ok && n > 0 {
+		return n
+	}
+	return 1
+}
+
 // Prioritize the list of commands, and return the next one (if any) that is ready to run.
 // If no command is ready to run, return nil
+// Every pool is limited to one running command.
 func NextRunnable(cmd []*Command, now time.Time) *Command {
-	// Assemble the list of all busy pools
-	busyPools := map[string]bool{}
+	return NextRunnableInPools(cmd, nil, now)
+}
+
+// Same as NextRunnable, but with a limit on the number of concurrent commands in each pool
+func NextRunnableInPools(cmd []*Command, pools PoolLimits, now time.Time) *Command {
+	runnable := RunnableCommands(cmd, pools, now)
+	if len(runnable) == 0 {
+		return nil
+	}
+	return runnable[0]
+}
+
+// Return every command that is ready to run, in order of priority.
+// The list never contains more commands from a pool than the pool has capacity for,
+// so the caller can launch all of them at once.
+func RunnableCommands(cmd []*Command, pools PoolLimits, now time.Time) []*Command {
+	// Count the running commands in each pool
+	running := map[string]int{}
 	for _, c := range cmd {
 		if atomic.LoadInt32(&c.isRunningAtomic) != 0 {
-			busyPools[c.Pool] = true
+			running[c.Pool]++
 		}
 	}
+	busyPools := map[string]bool{}
+	for pool, n := range running {
+		busyPools[pool] = n >= pools.limit(pool)
+	}
 
 	// Produce a filtered list of commands that are runnable
 	// Are we doing something wrong by reading the atomic variable isRunning twice?
@@ -214,13 +554,50 @@ func NextRunnable(cmd []*Command, now time.Time) *Command {
 			filtered = append(filtered, c)
 		}
 	}
-	if len(filtered) == 0 {
-		return nil
-	}
 	sortable := SortCommands{
 		List: filtered,
 		Now:  now,
 	}
 	sort.Sort(sort.Reverse(sortable))
-	return sortable.List[0]
+
+	// Take commands in order of priority, for as long as their pools have capacity
+	result := []*Command{}
+	for _, c := range sortable.List {
+		if running[c.Pool] < pools.limit(c.Pool) {
+			result = append(result, c)
+			running[c.Pool]++
+		}
+	}
+	return result
+}
+
+// Returns true if the pool can run another command
+func PoolHasCapacity(cmd []*Command, pools PoolLimits, pool string) bool {
+	running := 0
+	for _, c := range cmd {
+		if c.Pool == pool && c.IsRunning() {
+			running++
+		}
+	}
+	return running < pools.limit(pool)
+}
+
+// Returns the earliest time after 'now' at which a command becomes due, or the zero time if there is no such command.
+// Commands that are waiting for their pool, or for the commands that they come after, only become
+// runnable when another command finishes, so they are not considered here.
+func NextWakeup(cmd []*Command, now time.Time) time.Time {
+	next := time.Time{}
+	for _, c := range cmd {
+		if !c.Enabled || atomic.LoadInt32(&c.isRunningAtomic) != 0 {
+			continue
+		}
+		due := c.nextDue(now)
+		if retryAt := c.retryTime(); retryAt.After(now) && (due.IsZero() || retryAt.Before(due)) {
+			due = retryAt
+		}
+		if due.After(now) && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return next
 }
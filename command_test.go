@@ -1,8 +1,12 @@
 package scheduler
 
 import (
+	"io"
+	"runtime"
 	"testing"
 	"time"
+
+	"github.com/IMQS/log"
 )
 
 func TestDailyTasks(t *testing.T) {
@@ -154,3 +158,303 @@ func TestPools(t *testing.T) {
 		t.Fatal("Pools not respected, or ordering incorrect (3)")
 	}
 }
+
+func TestStatus(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+
+	regular := &Command{Name: "regular", Enabled: true, Interval: 30 * time.Minute, lastRun: nowPresent.Add(-10 * time.Minute)}
+	s := regular.Status(nowPresent)
+	if !s.NextRun.Equal(nowPresent.Add(20*time.Minute)) || s.Overdue != -20*60 || s.Interval != "30m0s" || s.Running {
+		t.Errorf("Regular status incorrect: %+v", s)
+	}
+
+	daily := &Command{Name: "daily", Enabled: true, Interval: 24 * time.Hour}
+	daily.SetStartTime(5, 0)
+	s = daily.Status(nowPresent)
+	if s.StartTime != "05:00" || !s.NextRun.Equal(time.Date(2015, 07, 15, 5, 0, 0, 0, loc)) {
+		t.Errorf("Daily status incorrect (not yet run): %+v", s)
+	}
+	daily.lastRun = nowPresent.Add(-time.Minute)
+	if s = daily.Status(nowPresent); !s.NextRun.Equal(time.Date(2015, 07, 16, 5, 0, 0, 0, loc)) {
+		t.Errorf("Daily status incorrect (already run): %+v", s)
+	}
+
+	cron, _ := ParseCron("0 6 * * *")
+	scheduled := &Command{Name: "cron", Enabled: true, Cron: cron}
+	s = scheduled.Status(nowPresent)
+	if s.Cron != "0 6 * * *" || s.Interval != "" || !s.NextRun.Equal(time.Date(2015, 07, 15, 6, 0, 0, 0, loc)) {
+		t.Errorf("Cron status incorrect: %+v", s)
+	}
+}
+
+// Run with -race to check that reading the state of a running command is safe
+func TestStatusWhileRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{
+		Name:     "short",
+		Enabled:  true,
+		Interval: time.Hour,
+		Exec:     "sh",
+		Params:   []string{"-c", "sleep 0.2; exit 1"},
+		Timeout:  time.Minute,
+		Retry:    RetryPolicy{MaxAttempts: 1, InitialDelay: time.Hour},
+	}
+	finished := startCommand(t, c)
+	m := NewMetrics()
+	for {
+		select {
+		case <-finished:
+			if s := c.Status(time.Now()); s.LastFinish.IsZero() || s.LastRun.IsZero() {
+				t.Errorf("Status incorrect after run: %+v", s)
+			}
+			return
+		default:
+		}
+		c.Status(time.Now())
+		m.Write(io.Discard, []*Command{c}, time.Now())
+		NextWakeup([]*Command{c}, time.Now())
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Run with -race to check that a config reload doesn't touch the config of a running command
+func TestReloadWhileRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{
+		Name:      "short",
+		Interval:  time.Hour,
+		Exec:      "sh",
+		Params:    []string{"-c", "sleep 0.2; exit 3"},
+		Timeout:   time.Minute,
+		ExitCodes: map[int]Outcome{3: OutcomeWarning},
+		Retry:     RetryPolicy{MaxAttempts: 1, InitialDelay: time.Hour},
+	}
+	finished := startCommand(t, c)
+	// This is what loadConfig does on every reload
+	c.Timeout = time.Millisecond
+	c.GracePeriod = time.Second
+	c.DisableLogs = true
+	c.ExitCodes = map[int]Outcome{}
+	c.Retry = RetryPolicy{MaxAttempts: 5, InitialDelay: time.Minute}
+	c.Interval = 24 * time.Hour
+	c.Exec = "false"
+	run := waitForRun(t, finished)
+	if run.Outcome != OutcomeWarning || !c.retryTime().IsZero() {
+		t.Errorf("Run must use the config that it started with, but got %v", run.Outcome)
+	}
+}
+
+// Launch the command, and return a channel that receives the run record when it finishes
+func startCommand(t *testing.T, c *Command) chan *RunRecord {
+	finished := make(chan *RunRecord, 1)
+	c.OnFinish = func(c *Command, run *RunRecord) {
+		finished <- run
+	}
+	c.Run(log.NewTesting(t), nil, TriggerSchedule)
+	return finished
+}
+
+func TestCancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{Name: "sleep", Exec: "sleep", Params: []string{"10"}, Timeout: time.Minute}
+	if c.Cancel() {
+		t.Fatalf("Cancel must fail when the command is not running")
+	}
+	finished := startCommand(t, c)
+	time.Sleep(100 * time.Millisecond)
+	if !c.Cancel() {
+		t.Fatalf("Cancel failed")
+	}
+	select {
+	case run := <-finished:
+		if run.Outcome != OutcomeCancelled {
+			t.Errorf("Expected outcome %v, but got %v", OutcomeCancelled, run.Outcome)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Cancelled command did not finish")
+	}
+}
+
+func TestPoolLimits(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+
+	cmd := []*Command{}
+	add := func(name, pool string, lastRun time.Time) *Command {
+		c := &Command{
+			Enabled:  true,
+			Interval: 1 * time.Minute,
+			Name:     name,
+			Pool:     pool,
+			lastRun:  lastRun,
+		}
+		cmd = append(cmd, c)
+		return c
+	}
+	l_a := add("a", "light", nowPresent.Add(-15*time.Hour))
+	l_b := add("b", "light", nowPresent.Add(-14*time.Hour))
+	l_c := add("c", "light", nowPresent.Add(-13*time.Hour))
+	db_a := add("d", "db", nowPresent.Add(-1*time.Hour))
+	add("e", "db", nowPresent.Add(-2*time.Hour))
+	pools := PoolLimits{"light": 2}
+
+	// Priority still applies within the pool
+	if next := NextRunnableInPools(cmd, pools, nowPresent); next != l_a {
+		t.Fatalf("Ordering incorrect within pool")
+	}
+	l_a.isRunningAtomic = 1
+	if next := NextRunnableInPools(cmd, pools, nowPresent); next != l_b {
+		t.Fatalf("Pool with limit of 2 must accept a second command")
+	}
+	l_b.isRunningAtomic = 1
+	db_a.isRunningAtomic = 1
+	if next := NextRunnableInPools(cmd, pools, nowPresent); next != nil {
+		t.Fatalf("Pool limits not respected: %v", next.Name)
+	}
+	// a finishes
+	l_a.isRunningAtomic = 0
+	l_a.lastRun = nowPresent
+	if next := NextRunnableInPools(cmd, pools, nowPresent); next != l_c {
+		t.Fatalf("Expected c to run when light pool has capacity")
+	}
+}
+
+func TestPoolHasCapacity(t *testing.T) {
+	a := &Command{Name: "a", Pool: "light"}
+	b := &Command{Name: "b", Pool: "light"}
+	c := &Command{Name: "c", Pool: "db"}
+	cmd := []*Command{a, b, c}
+	pools := PoolLimits{"light": 2}
+	a.isRunningAtomic = 1
+	if !PoolHasCapacity(cmd, pools, "light") {
+		t.Errorf("Pool with limit of 2 must have capacity for a second command")
+	}
+	b.isRunningAtomic = 1
+	if PoolHasCapacity(cmd, pools, "light") {
+		t.Errorf("Full pool must not have capacity")
+	}
+	if !PoolHasCapacity(cmd, pools, "db") {
+		t.Errorf("Idle pool must have capacity")
+	}
+}
+
+func TestQueueHttp(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+	c := &Command{Name: "a", Interval: time.Hour, lastRun: nowPresent}
+	c.Queue(TriggerDependency, nowPresent, nil)
+	if c.MustRun(nowPresent) {
+		t.Errorf("A disabled command must not run when it is queued by a dependency")
+	}
+	// A human asking for the command to run overrides the disabled state
+	c.Queue(TriggerHttp, nowPresent, nil)
+	if !c.MustRun(nowPresent) {
+		t.Errorf("A command queued over HTTP must run even if it is disabled")
+	}
+	if trigger, _ := c.takeQueued(); trigger != TriggerHttp {
+		t.Errorf("Expected trigger %v, but got %v", TriggerHttp, trigger)
+	}
+
+	// A queued run can only have one set of variables
+	if !c.Queue(TriggerHttp, nowPresent, map[string]string{"SRC": "a"}) || !c.Queue(TriggerHttp, nowPresent, map[string]string{"SRC": "a"}) {
+		t.Errorf("Queueing with the same variables must succeed")
+	}
+	if c.Queue(TriggerHttp, nowPresent, map[string]string{"SRC": "b"}) {
+		t.Errorf("Queueing with different variables must fail")
+	}
+	if c.Queue(TriggerHttp, nowPresent, nil) {
+		t.Errorf("Queueing without variables must fail when the queued run has variables")
+	}
+	if _, vars := c.takeQueued(); vars["SRC"] != "a" {
+		t.Errorf("Queued variables incorrect: %v", vars)
+	}
+	c.Queue(TriggerHttp, nowPresent, nil)
+	if c.Queue(TriggerHttp, nowPresent, map[string]string{"SRC": "a"}) {
+		t.Errorf("Queueing with variables must fail when the queued run has none")
+	}
+}
+
+func TestDirectRunKeepsQueue(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{Name: "import", Exec: "true", Timeout: time.Minute}
+	c.Queue(TriggerHttp, time.Now(), map[string]string{"SRC": "batch1"})
+	finished := make(chan *RunRecord, 1)
+	c.OnFinish = func(c *Command, run *RunRecord) {
+		finished <- run
+	}
+	c.Run(log.NewTesting(t), nil, TriggerHttp)
+	waitForRun(t, finished)
+	if trigger, vars := c.takeQueued(); trigger != TriggerHttp || vars["SRC"] != "batch1" {
+		t.Errorf("A direct run must not take the queued run, but the queue has %v %v", trigger, vars)
+	}
+}
+
+func TestOverlayVariables(t *testing.T) {
+	c := &Command{Name: "import", AllowVariables: []string{"LOCATOR_SRC"}}
+	base := map[string]string{"LOCATOR_SRC": "c:\\imports", "JOB_SERVICE_URL": "http://localhost"}
+	vars, err := c.OverlayVariables(base, map[string]string{"LOCATOR_SRC": "c:\\imports\\batch1"})
+	if err != nil {
+		t.Fatalf("Overlay failed: %v", err)
+	}
+	if vars["LOCATOR_SRC"] != "c:\\imports\\batch1" || vars["JOB_SERVICE_URL"] != "http://localhost" {
+		t.Errorf("Overlay incorrect: %v", vars)
+	}
+	if base["LOCATOR_SRC"] != "c:\\imports" {
+		t.Errorf("Overlay must not modify the original variables")
+	}
+	if _, err := c.OverlayVariables(base, map[string]string{"JOB_SERVICE_URL": "http://evil"}); err == nil {
+		t.Errorf("Expected variable that is not allowed to be rejected")
+	}
+}
+
+func TestRunnableCommands(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+
+	cmd := []*Command{}
+	add := func(name, pool string, interval time.Duration, lastRun time.Time) *Command {
+		c := &Command{Enabled: true, Interval: interval, Name: name, Pool: pool, lastRun: lastRun}
+		cmd = append(cmd, c)
+		return c
+	}
+	a := add("a", "light", time.Minute, nowPresent.Add(-15*time.Hour))
+	b := add("b", "light", time.Minute, nowPresent.Add(-14*time.Hour))
+	add("c", "light", time.Minute, nowPresent.Add(-13*time.Hour))
+	d := add("d", "db", time.Minute, nowPresent.Add(-12*time.Hour))
+	add("e", "db", time.Minute, nowPresent.Add(-11*time.Hour))
+	f := add("f", "import", time.Hour, nowPresent.Add(-50*time.Minute))
+
+	runnable := RunnableCommands(cmd, PoolLimits{"light": 2}, nowPresent)
+	if len(runnable) != 3 || runnable[0] != a || runnable[1] != b || runnable[2] != d {
+		names := []string{}
+		for _, c := range runnable {
+			names = append(names, c.Name)
+		}
+		t.Fatalf("Runnable commands incorrect: %v", names)
+	}
+
+	// Once everything that is due has run, the next wakeup is when f becomes due
+	for _, c := range cmd {
+		if c != f {
+			c.lastRun = nowPresent
+		}
+	}
+	if next := NextWakeup(cmd, nowPresent); !next.Equal(nowPresent.Add(time.Minute)) {
+		t.Errorf("Next wakeup incorrect: %v", next)
+	}
+	for _, c := range cmd {
+		c.Interval = time.Hour
+	}
+	if next := NextWakeup(cmd, nowPresent); !next.Equal(nowPresent.Add(10 * time.Minute)) {
+		t.Errorf("Next wakeup incorrect: %v", next)
+	}
+}
@@ -14,16 +14,111 @@ const serviceConfigFileName = "scheduled-tasks.json"
 const serviceConfigVersion = 1
 const serviceName = "ImqsScheduler"
 
+// How to retry a failed run. See RetryPolicy.
+type RetryConfig struct {
+	MaxAttempts    int     // Maximum number of retries. Zero disables retries.
+	InitialDelay   string  // eg "5m"
+	Multiplier     float64 // eg 2, to double the delay after every retry
+	ExitCodes      []int   // Exit codes that are retryable. If empty, then any failed exit code is retryable.
+	OnTimeout      bool
+	OnStartFailure bool
+}
+
 // If you add or remove any members here, be sure to update HashSignature
 type ConfigCommand struct {
-	Name        string
-	Pool        string
-	Interval    string
-	Timeout     string
-	Command     string
-	Params      []string
-	StartTime   string
-	DisableLogs bool // If true, then never emit stdout or stderr to our logs. This was created to silence output-heavy jobs such as tile cache seeding, because they flood our log aggregator (Datadog)
+	Name           string
+	Pool           string
+	Interval       string
+	Timeout        string
+	GracePeriod    string // On timeout, ask the process to terminate, and wait this long (eg "30s") before killing it. By default, we kill immediately.
+	Command        string
+	Params         []string // Each element is passed to the command as exactly one argument
+	CommandLine    string   // A full command line, such as `"C:\Program Files\IMQS\tool.exe" import "!LOCATOR_SRC"`. If specified, Command and Params are ignored.
+	StartTime      string
+	Cron           string            // A cron expression such as "*/15 8-17 * * MON-FRI". If specified, then Interval and StartTime are ignored.
+	Weekday        string            // If specified (eg "Sunday"), then this is a weekly task that runs at StartTime. Interval is ignored.
+	DayOfMonth     string            // If specified (eg "1" or "last"), then this is a monthly task that runs at StartTime. Interval is ignored. May not be combined with Weekday.
+	After          []string          // If specified, then the task has no schedule of its own. It runs after all of these tasks have succeeded.
+	OnSuccess      []string          // Tasks to run when this task succeeds
+	OnFailure      []string          // Tasks to run when this task fails
+	Env            map[string]string // Extra environment variables, such as PGPASSFILE. Variables (eg !LOCATOR_SRC) are substituted into the values.
+	InheritEnv     *bool             // If false, then the process does not inherit the scheduler's environment. Defaults to true.
+	WorkingDir     string            // Directory in which to start the process. Defaults to the scheduler's current directory.
+	AllowVariables []string          // Variables (eg LOCATOR_SRC) that may be supplied by whoever triggers the task over HTTP
+	Webhooks       []ConfigWebhook   // Webhooks for this task only
+	ExitCodes      map[int]string    // Outcomes of specific exit codes, such as {"2": "success", "3": "warning"}. Otherwise zero is success, and anything else is failure.
+	Retry          RetryConfig
+	DisableLogs    bool // If true, then never emit stdout or stderr to our logs. This was created to silence output-heavy jobs such as tile cache seeding, because they flood our log aggregator (Datadog)
+}
+
+// Where we store the history of runs, and how much of it we keep
+type HistoryConfig struct {
+	Filename string // If empty, a default path is used
+	MaxRuns  int    // Maximum number of runs to keep. Zero means use the default.
+	MaxAge   string // Maximum age of runs to keep, such as "720h". Empty means use the default.
+}
+
+// Where we store the output of each run, and how much of it we keep.
+// The defaults keep at most about 200 MB on disk.
+type OutputConfig struct {
+	Dir      string // If empty, then c:/imqsvar/logs/scheduler-runs is used
+	Disable  bool   // If true, then output is not written to files
+	MaxBytes int64  // Maximum size of a single output file. Zero means 1 MB.
+	MaxFiles int    // Maximum number of output files to keep. Zero means 200.
+	MaxAge   string // Maximum age of output files to keep, such as "168h". Empty means "720h" (30 days).
+}
+
+// POST a notification to some URLs when a task fails, times out, recovers, or misses its window. See WebhookRule.
+type ConfigWebhook struct {
+	On          []string // Any of "failure", "timeout", "recovery", "window-missed"
+	URLs        []string
+	Commands    []string          // Only for global webhooks. If empty, then the webhook applies to all tasks.
+	Body        string            // A Go text/template, such as {"text": {{json .Command}}}. If empty, then the whole notification is sent as JSON.
+	ContentType string            // Defaults to application/json
+	Headers     map[string]string // Such as an Authorization header
+	MaxAttempts int               // Defaults to 3
+	RetryDelay  string            // Delay before the first retry, which doubles with every retry. Defaults to "10s".
+}
+
+// Send failure and timeout mails through an SMTP server. See Mailer.
+type EmailConfig struct {
+	Host           string // If empty, then no mail is sent
+	Port           int    // Defaults to 25, or 465 when TLS is "tls"
+	TLS            string // "none", "starttls", or "tls". Defaults to "starttls".
+	Username       string // If empty, then we don't authenticate. May not be used with TLS "none", unless Host is localhost.
+	Password       string
+	From           string
+	DigestInterval string // Failures after the first are collected, and mailed at most this often. Defaults to "1h".
+	Rules          []ConfigEmailRule
+}
+
+// Who to mail when a task fails
+type ConfigEmailRule struct {
+	To       []string
+	On       []string // "failure" and/or "timeout". Defaults to both.
+	Commands []string // If Commands and Pools are both empty, then the rule applies to all tasks
+	Pools    []string
+}
+
+// A token that may access the HTTP API. See ApiToken.
+type ConfigToken struct {
+	Name        string   // Identifies the token in our logs, and in HMAC signed requests
+	Secret      string   // Sent as a bearer token, or used as the HMAC key
+	Permissions []string // Any of "read", "trigger", "cancel", "admin"
+	Commands    []string // If Commands or Pools is not empty, then trigger and cancel are limited to these commands,
+	Pools       []string // and the commands in these pools
+}
+
+// The HTTP API
+type HttpConfig struct {
+	Listen string        // Address to listen on, such as "127.0.0.1:2014". Defaults to ":2014". Only read at startup.
+	Tokens []ConfigToken // If empty, then the API does not require authentication
+}
+
+// A pool of commands, and the number of them that may run at the same time
+type ConfigPool struct {
+	Name          string
+	MaxConcurrent int
 }
 
 // If you add or remove any members here, be sure to update HashSignature
@@ -32,6 +127,13 @@ type Config struct {
 	Enabled   []string
 	Disabled  []string
 	Commands  []ConfigCommand
+	Pools     []ConfigPool // Pools that are not listed here may only run one command at a time
+	StateFile string       // Path of the file where we remember when each command last ran. If empty, a default path is used.
+	History   HistoryConfig
+	Output    OutputConfig
+	Http      HttpConfig
+	Webhooks  []ConfigWebhook // Webhooks for all tasks
+	Email     EmailConfig
 }
 
 func (c *Config) LoadFile(filename string) error {
@@ -81,7 +183,23 @@ func (c *Config) SetCommandEnabled(cmd string, enabled bool) {
 }
 
 func (c *ConfigCommand) HashSignature() string {
-	return c.Name + "." + c.Pool + "." + c.Interval + "." + c.Timeout + "." + c.Command + "." + strings.Join(c.Params, ",") + "." + c.StartTime + fmt.Sprintf("%v", c.DisableLogs)
+	return c.Name + "." + c.Pool + "." + c.Interval + "." + c.Timeout + "." + c.GracePeriod + "." + c.Command + "." + strings.Join(c.Params, ",") + "." + c.CommandLine + "." + c.StartTime + "." + c.Cron + "." + c.Weekday + "." + c.DayOfMonth + "." + strings.Join(c.After, ",") + "." + strings.Join(c.OnSuccess, ",") + "." + strings.Join(c.OnFailure, ",") + fmt.Sprintf("%v", c.ExitCodes) + "." + fmt.Sprintf("%+v", c.Retry) + "." + c.hashEnv() + "." + c.WorkingDir + "." + strings.Join(c.AllowVariables, ",") + fmt.Sprintf("%+v", c.Webhooks) + fmt.Sprintf("%v", c.DisableLogs)
+}
+
+func (c *ConfigCommand) hashEnv() string {
+	keys := []string{}
+	for k := range c.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range keys {
+		s += "(" + k + ")=(" + c.Env[k] + ")"
+	}
+	if c.InheritEnv != nil {
+		s += fmt.Sprintf("inherit=%v", *c.InheritEnv)
+	}
+	return s
 }
 
 // Returns a hex encoded SHA1 hash of all the contents of the configuration. This is used to
@@ -91,6 +209,13 @@ func (c *Config) HashSignature() string {
 	s := ""
 	s += "> Enabled: " + strings.Join(c.Enabled, ",")
 	s += "> Disabled: " + strings.Join(c.Disabled, ",")
+	s += "> StateFile: " + c.StateFile
+	s += fmt.Sprintf("> History: %+v", c.History)
+	s += fmt.Sprintf("> Pools: %+v", c.Pools)
+	s += fmt.Sprintf("> Output: %+v", c.Output)
+	s += fmt.Sprintf("> Http: %+v", c.Http)
+	s += fmt.Sprintf("> Webhooks: %+v", c.Webhooks)
+	s += fmt.Sprintf("> Email: %+v", c.Email)
 	keys := []string{}
 	for k, _ := range c.Variables {
 		keys = append(keys, k)
@@ -0,0 +1,317 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cron expression, parsed into bit sets.
+// We accept the standard 5 field form (minute hour day-of-month month day-of-week),
+// as well as a 6 field form which has an extra seconds field at the front.
+// Each field may be '*', a single value, a range 'a-b', a step '*/n' or 'a-b/n',
+// or a comma separated list of any of those. Months and days of the week may be
+// specified by their three letter English names (JAN-DEC, SUN-SAT).
+// The day-of-month field also accepts 'L', which means the last day of the month.
+// If both day-of-month and day-of-week are restricted, then a day matches when
+// either of them matches. This is the same behaviour as the classic Vixie cron.
+type CronSchedule struct {
+	Expr string // The original expression, as specified in the config
+
+	second uint64
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	domLast bool // Day-of-month includes 'L'
+	domStar bool // Day-of-month was '*' or '?'
+	dowStar bool // Day-of-week was '*' or '?'
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronSecond = cronField{"second", 0, 59, nil}
+	cronMinute = cronField{"minute", 0, 59, nil}
+	cronHour   = cronField{"hour", 0, 23, nil}
+	cronDom    = cronField{"day-of-month", 1, 31, nil}
+	cronMonth  = cronField{"month", 1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// We accept 7 as an alias for Sunday, and fold it into 0 after parsing
+	cronDow = cronField{"day-of-week", 0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// Don't search further than this into the future for the next activation time.
+// An expression such as "0 0 30 2 *" (Feb 30th) will never fire.
+const cronSearchYears = 5
+
+// Parse a cron expression
+func ParseCron(expr string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("Expected 5 or 6 fields in cron expression '%v', but found %v", expr, len(fields))
+	}
+
+	s := &CronSchedule{Expr: expr}
+	var err error
+	if s.second, err = parseCronField(fields[0], cronSecond); err != nil {
+		return nil, err
+	}
+	if s.minute, err = parseCronField(fields[1], cronMinute); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[2], cronHour); err != nil {
+		return nil, err
+	}
+	if s.dom, s.domLast, err = parseDomField(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[4], cronMonth); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[5], cronDow); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = (s.dow | 1) &^ (1 << 7)
+	}
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+	return s, nil
+}
+
+// Build a schedule that fires once a week, on the given day, at hour:minute
+func WeeklySchedule(day time.Weekday, hour, minute int) (*CronSchedule, error) {
+	return ParseCron(fmt.Sprintf("%v %v * * %v", minute, hour, int(day)))
+}
+
+// Build a schedule that fires once a month, on the given day, at hour:minute.
+// A day of -1 means the last day of the month.
+// Note that a day such as 31 will skip months that are shorter than that.
+func MonthlySchedule(day, hour, minute int) (*CronSchedule, error) {
+	dom := strconv.Itoa(day)
+	if day == -1 {
+		dom = "L"
+	}
+	return ParseCron(fmt.Sprintf("%v %v %v * *", minute, hour, dom))
+}
+
+// Parse a day of the week, such as "Sunday" or "sun"
+func ParseWeekday(day string) (time.Weekday, error) {
+	d := strings.ToLower(strings.TrimSpace(day))
+	for i := time.Sunday; i <= time.Saturday; i++ {
+		name := strings.ToLower(i.String())
+		if d == name || d == name[:3] {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid day of the week '%v'", day)
+}
+
+// Parse a day of the month, such as "1", "15", or "last".
+// "last" is returned as -1.
+func ParseDayOfMonth(day string) (int, error) {
+	d := strings.ToLower(strings.TrimSpace(day))
+	if d == "last" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(d)
+	if err != nil || n < 1 || n > 31 {
+		return 0, fmt.Errorf("Invalid day of the month '%v'. Must be 1..31 or 'last'", day)
+	}
+	return n, nil
+}
+
+func (s *CronSchedule) String() string {
+	return s.Expr
+}
+
+// Returns the first activation time that is strictly after t.
+// If there is no such time within the next few years, then the zero time is returned.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// Round up to the next whole second
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + cronSearchYears
+
+wrap:
+	for t.Year() <= yearLimit {
+		for !hasBit(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			if t.Month() == time.January {
+				continue wrap
+			}
+		}
+		for !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			if t.Day() == 1 {
+				continue wrap
+			}
+		}
+		for !hasBit(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if t.Hour() == 0 {
+				continue wrap
+			}
+		}
+		for !hasBit(s.minute, t.Minute()) {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			if t.Minute() == 0 {
+				continue wrap
+			}
+		}
+		for !hasBit(s.second, t.Second()) {
+			t = t.Add(time.Second)
+			if t.Second() == 0 {
+				continue wrap
+			}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := hasBit(s.dom, t.Day()) || (s.domLast && t.Day() == daysInMonth(t))
+	dowMatch := hasBit(s.dow, int(t.Weekday()))
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func daysInMonth(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
+
+func hasBit(set uint64, bit int) bool {
+	return set&(1<<uint(bit)) != 0
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		b, err := parseCronPart(part, f)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
+	}
+	return bits, nil
+}
+
+// The day-of-month field is special, because it may include 'L'
+func parseDomField(field string) (uint64, bool, error) {
+	var bits uint64
+	last := false
+	for _, part := range strings.Split(field, ",") {
+		if strings.ToUpper(part) == "L" {
+			last = true
+			continue
+		}
+		b, err := parseCronPart(part, cronDom)
+		if err != nil {
+			return 0, false, err
+		}
+		bits |= b
+	}
+	return bits, last, nil
+}
+
+// Parse one element of a comma separated list, such as "5", "1-5", "*/15", or "MON-FRI/2"
+func parseCronPart(part string, f cronField) (uint64, error) {
+	rng := part
+	step := 1
+	hasStep := false
+	if slash := strings.Index(part, "/"); slash != -1 {
+		rng = part[:slash]
+		var err error
+		step, err = strconv.Atoi(part[slash+1:])
+		if err != nil || step <= 0 {
+			return 0, fmt.Errorf("Invalid step in %v field '%v'", f.name, part)
+		}
+		hasStep = true
+	}
+
+	// Don't let '*' or a step in the day-of-week field include the alias for Sunday
+	top := f.max
+	if f.max == 7 {
+		top = 6
+	}
+
+	var low, high int
+	if rng == "*" || rng == "?" {
+		low, high = f.min, top
+	} else if dash := strings.Index(rng, "-"); dash != -1 {
+		var err error
+		if low, err = parseCronValue(rng[:dash], f); err != nil {
+			return 0, err
+		}
+		if high, err = parseCronValue(rng[dash+1:], f); err != nil {
+			return 0, err
+		}
+		if high < low {
+			return 0, fmt.Errorf("Invalid range in %v field '%v'", f.name, part)
+		}
+	} else {
+		var err error
+		if low, err = parseCronValue(rng, f); err != nil {
+			return 0, err
+		}
+		high = low
+		if hasStep {
+			// "5/15" means "starting at 5, every 15"
+			high = top
+		}
+	}
+
+	var bits uint64
+	for i := low; i <= high; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+func parseCronValue(v string, f cronField) (int, error) {
+	if n, ok := f.names[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value '%v' in %v field", v, f.name)
+	}
+	if n < f.min || n > f.max {
+		return 0, fmt.Errorf("Value %v in %v field is out of range [%v-%v]", n, f.name, f.min, f.max)
+	}
+	return n, nil
+}
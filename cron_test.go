@@ -0,0 +1,192 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{
+		"* * * * *",
+		"*/15 8-17 * * MON-FRI",
+		"30 2 * * 1-5",
+		"0 0 1,15 * *",
+		"0 30 2 * * *",
+		"0 0 * jan-mar,dec sun",
+		"5/10 * * * 7",
+		"@daily",
+		"@Hourly",
+		"0 1 L * *",
+		"0 1 1,L * *",
+	}
+	for _, expr := range valid {
+		if _, err := ParseCron(expr); err != nil {
+			t.Errorf("Expected '%v' to parse, but got %v", expr, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * * MON-FOO",
+		"1,,2 * * * *",
+	}
+	for _, expr := range invalid {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Expected '%v' to fail parsing", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	loc := time.FixedZone("Pretoria", 7200)
+	// Wednesday
+	base := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+	cases := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", base, time.Date(2015, 07, 15, 5, 4, 0, 0, loc)},
+		{"*/15 * * * *", base, time.Date(2015, 07, 15, 5, 15, 0, 0, loc)},
+		{"*/15 8-17 * * MON-FRI", base, time.Date(2015, 07, 15, 8, 0, 0, 0, loc)},
+		{"*/15 8-17 * * MON-FRI", time.Date(2015, 07, 17, 17, 45, 0, 0, loc), time.Date(2015, 07, 20, 8, 0, 0, 0, loc)},
+		{"30 2 * * 1-5", base, time.Date(2015, 07, 16, 2, 30, 0, 0, loc)},
+		{"0 0 1 * *", base, time.Date(2015, 8, 1, 0, 0, 0, 0, loc)},
+		{"0 0 * * 0", base, time.Date(2015, 07, 19, 0, 0, 0, 0, loc)},
+		{"0 0 * * 7", base, time.Date(2015, 07, 19, 0, 0, 0, 0, loc)},
+		{"0 0 29 2 *", base, time.Date(2016, 2, 29, 0, 0, 0, 0, loc)},
+		{"10 * * * * *", base, time.Date(2015, 07, 15, 5, 4, 10, 0, loc)},
+		{"0 0 31 12 *", time.Date(2015, 12, 31, 23, 59, 59, 0, loc), time.Date(2016, 12, 31, 0, 0, 0, 0, loc)},
+		// Either day-of-month or day-of-week may match, if both are restricted
+		{"0 0 20 * SUN", base, time.Date(2015, 07, 19, 0, 0, 0, 0, loc)},
+		// Strictly after
+		{"0 5 * * *", time.Date(2015, 07, 15, 5, 0, 0, 0, loc), time.Date(2015, 07, 16, 5, 0, 0, 0, loc)},
+		// Never
+		{"0 0 30 2 *", base, time.Time{}},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("Failed to parse '%v': %v", c.expr, err)
+		}
+		if next := s.Next(c.from); !next.Equal(c.expected) {
+			t.Errorf("'%v' after %v: expected %v, but got %v", c.expr, c.from, c.expected, next)
+		}
+	}
+}
+
+func TestCronTasks(t *testing.T) {
+	loc := time.FixedZone("Pretoria", 7200)
+	nowPresent := time.Date(2015, 07, 15, 2, 35, 0, 0, loc)
+
+	cron, _ := ParseCron("30 2 * * MON-FRI")
+	c := Command{
+		Enabled: true,
+		Cron:    cron,
+	}
+
+	// Never run before, and we're inside the window
+	if !c.MustRun(nowPresent) || c.timeOverdue(nowPresent) != 5*time.Minute {
+		t.Errorf("Expected cron task to run 5 minutes after its start time")
+	}
+	// Before the start time
+	if c.MustRun(nowPresent.Add(-10 * time.Minute)) {
+		t.Errorf("Cron task must not run before its start time")
+	}
+	// Outside of the window
+	if c.MustRun(nowPresent.Add(3 * time.Hour)) {
+		t.Errorf("Cron task must not run outside of its start window")
+	}
+	// Already ran
+	c.lastRun = nowPresent.Add(-4 * time.Minute)
+	if c.MustRun(nowPresent) || c.MustRun(nowPresent.Add(time.Hour)) {
+		t.Errorf("Cron task must not run twice")
+	}
+	// Next day
+	if !c.MustRun(nowPresent.Add(24 * time.Hour)) {
+		t.Errorf("Expected cron task to run on the next day")
+	}
+	// Saturday
+	if c.MustRun(nowPresent.Add(3 * 24 * time.Hour)) {
+		t.Errorf("Cron task must not run on a Saturday")
+	}
+
+	// Cron tasks are prioritized over regular interval tasks
+	regular := &Command{
+		Enabled:  true,
+		Interval: 15 * time.Minute,
+		lastRun:  nowPresent.Add(-5 * time.Hour),
+	}
+	c.lastRun = time.Time{}
+	if next := NextRunnable([]*Command{regular, &c}, nowPresent); next != &c {
+		t.Errorf("Expected cron task to be prioritized")
+	}
+}
+
+func TestCalendarSchedules(t *testing.T) {
+	loc := time.FixedZone("Pretoria", 7200)
+	// Wednesday
+	base := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+
+	day, err := ParseWeekday("Sunday")
+	if err != nil || day != time.Sunday {
+		t.Fatalf("Failed to parse Sunday")
+	}
+	if day, err = ParseWeekday("fri"); err != nil || day != time.Friday {
+		t.Fatalf("Failed to parse fri")
+	}
+	if _, err = ParseWeekday("funday"); err == nil {
+		t.Fatalf("Expected funday to fail")
+	}
+	for _, bad := range []string{"0", "32", "first", ""} {
+		if _, err = ParseDayOfMonth(bad); err == nil {
+			t.Errorf("Expected day of month '%v' to fail", bad)
+		}
+	}
+
+	weekly, _ := WeeklySchedule(time.Sunday, 3, 0)
+	if next := weekly.Next(base); !next.Equal(time.Date(2015, 07, 19, 3, 0, 0, 0, loc)) {
+		t.Errorf("Weekly schedule incorrect: %v", next)
+	}
+
+	first, _ := ParseDayOfMonth("1")
+	monthly, _ := MonthlySchedule(first, 1, 0)
+	if next := monthly.Next(base); !next.Equal(time.Date(2015, 8, 1, 1, 0, 0, 0, loc)) {
+		t.Errorf("Monthly schedule incorrect: %v", next)
+	}
+
+	last, _ := ParseDayOfMonth("last")
+	endOfMonth, _ := MonthlySchedule(last, 23, 30)
+	expected := []time.Time{
+		time.Date(2015, 07, 31, 23, 30, 0, 0, loc),
+		time.Date(2015, 8, 31, 23, 30, 0, 0, loc),
+		time.Date(2015, 9, 30, 23, 30, 0, 0, loc),
+	}
+	next := base
+	for _, e := range expected {
+		if next = endOfMonth.Next(next); !next.Equal(e) {
+			t.Errorf("Last day of month schedule incorrect: expected %v, but got %v", e, next)
+		}
+	}
+	if next = endOfMonth.Next(time.Date(2016, 2, 1, 0, 0, 0, 0, loc)); !next.Equal(time.Date(2016, 2, 29, 23, 30, 0, 0, loc)) {
+		t.Errorf("Last day of February incorrect: %v", next)
+	}
+
+	// A weekly task gets the same start window as a daily task
+	c := Command{
+		Enabled: true,
+		Cron:    weekly,
+	}
+	sunday := time.Date(2015, 07, 19, 3, 0, 0, 0, loc)
+	if !c.MustRun(sunday.Add(time.Hour)) || c.MustRun(sunday.Add(-time.Hour)) || c.MustRun(sunday.Add(3*time.Hour)) {
+		t.Errorf("Weekly start window incorrect")
+	}
+}
@@ -0,0 +1,219 @@
+package scheduler
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Dependencies between commands.
+//
+// A command with 'After' has no schedule of its own. It runs once every command that
+// it comes after has succeeded since it last ran. This is how we express a chain such
+// as import -> reindex -> tile seed.
+//
+// 'OnSuccess' and 'OnFailure' queue other commands when a command finishes. A queued
+// command runs as soon as its pool allows, regardless of its own schedule.
+
+// Link the dependency names of every command to the commands themselves.
+// If a name is unknown, or if the dependencies form a cycle, then an error is returned.
+// If there is a cycle, then no dependencies are linked at all, so that we can't end up
+// running commands in an endless loop.
+// An unknown name in OnSuccess or OnFailure is skipped, but if any name in After is unknown,
+// then none of After is linked, and the command never runs. Running it after only some of
+// the commands that it must wait for could be worse than not running it at all.
+func ResolveDependencies(cmds []*Command) error {
+	byName := map[string]*Command{}
+	for _, c := range cmds {
+		byName[c.Name] = c
+	}
+	resolve := func(c *Command, names []string, errs *[]string) ([]*Command, bool) {
+		list := []*Command{}
+		ok := true
+		for _, name := range names {
+			if d := byName[name]; d != nil {
+				list = append(list, d)
+			} else {
+				*errs = append(*errs, fmt.Sprintf("'%v' refers to unknown command '%v'", c.Name, name))
+				ok = false
+			}
+		}
+		return list, ok
+	}
+
+	errs := []string{}
+	after := map[*Command][]*Command{}
+	onSuccess := map[*Command][]*Command{}
+	onFailure := map[*Command][]*Command{}
+	for _, c := range cmds {
+		if list, ok := resolve(c, c.After, &errs); ok {
+			after[c] = list
+		}
+		onSuccess[c], _ = resolve(c, c.OnSuccess, &errs)
+		onFailure[c], _ = resolve(c, c.OnFailure, &errs)
+	}
+
+	// Build the graph of "X causes Y to run", and look for cycles
+	next := map[*Command][]*Command{}
+	for _, c := range cmds {
+		for _, a := range after[c] {
+			next[a] = append(next[a], c)
+		}
+		next[c] = append(next[c], onSuccess[c]...)
+		next[c] = append(next[c], onFailure[c]...)
+	}
+	if cycle := findCycle(cmds, next); cycle != nil {
+		names := []string{}
+		for _, c := range cycle {
+			names = append(names, c.Name)
+		}
+		for _, c := range cmds {
+			c.after, c.onSuccess, c.onFailure = nil, nil, nil
+		}
+		return fmt.Errorf("Dependency cycle: %v", strings.Join(names, " -> "))
+	}
+
+	for _, c := range cmds {
+		c.after, c.onSuccess, c.onFailure = after[c], onSuccess[c], onFailure[c]
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("Invalid dependencies: %v", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Returns the commands that form a cycle (with the first command repeated at the end), or nil if there is no cycle
+func findCycle(cmds []*Command, next map[*Command][]*Command) []*Command {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[*Command]int{}
+	path := []*Command{}
+	var visit func(c *Command) []*Command
+	visit = func(c *Command) []*Command {
+		state[c] = visiting
+		path = append(path, c)
+		for _, n := range next[c] {
+			if state[n] == visiting {
+				for i := range path {
+					if path[i] == n {
+						return append(append([]*Command{}, path[i:]...), n)
+					}
+				}
+			} else if state[n] == unvisited {
+				if cycle := visit(n); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[c] = done
+		return nil
+	}
+	for _, c := range cmds {
+		if state[c] == unvisited {
+			if cycle := visit(c); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if this command's runs are driven by the commands that it comes after
+func (c *Command) isDependent() bool {
+	return len(c.After) != 0
+}
+
+// If every command that we come after has succeeded since our last run, and none of
+// them are running, then return the time of the most recent of those successes.
+// Otherwise, return the zero time.
+func (c *Command) dependenciesReady() time.Time {
+	if len(c.after) == 0 {
+		return time.Time{}
+	}
+	ready := time.Time{}
+	lastRun := c.LastRun()
+	for _, a := range c.after {
+		lastSuccess := a.LastSuccess()
+		if atomic.LoadInt32(&a.isRunningAtomic) != 0 || !lastSuccess.After(lastRun) {
+			return time.Time{}
+		}
+		if lastSuccess.After(ready) {
+			ready = lastSuccess
+		}
+	}
+	return ready
+}
+
+// Queue the command to run as soon as possible, regardless of its schedule.
+// The command still waits for its pool to have capacity.
+// A command that is queued by a human (TriggerHttp) runs even if it is disabled.
+// If variables is not empty, then they overlay the variables of the queued run. A queued run
+// can only have one set of variables, so if the command is already queued with different
+// variables, then nothing is changed, and false is returned. No variables at all counts as
+// a set of its own, so that nobody gets a run with somebody else's variables.
+func (c *Command) Queue(trigger Trigger, now time.Time, variables map[string]string) bool {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if c.queued != "" && !maps.Equal(variables, c.queuedVariables) {
+		return false
+	}
+	if c.queued == "" {
+		c.queuedAt = now
+	}
+	if c.queued == "" || trigger == TriggerHttp {
+		c.queued = trigger
+	}
+	if len(variables) != 0 {
+		c.queuedVariables = makeCopyOfVariables(variables)
+	}
+	return true
+}
+
+// Returns the time at which the command was queued, or the zero time if it is not queued
+func (c *Command) queuedTime() time.Time {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.queuedAt
+}
+
+// Returns the trigger that queued the command, or an empty string if it is not queued
+func (c *Command) queuedTrigger() Trigger {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.queued
+}
+
+// Remove the command from the queue, returning the trigger that queued it (if any),
+// and the variables that it was queued with
+func (c *Command) takeQueued() (Trigger, map[string]string) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	t, v := c.queued, c.queuedVariables
+	c.queued = ""
+	c.queuedAt = time.Time{}
+	c.queuedVariables = nil
+	return t, v
+}
+
+// Queue the commands that must run after a run has finished. The lists are the ones that
+// Run copied when it launched the command.
+func queueFollowers(run *RunRecord, onSuccess, onFailure []*Command) {
+	var followers []*Command
+	switch {
+	case run.Outcome.Succeeded():
+		followers = onSuccess
+	case run.Outcome == OutcomeCancelled:
+		// A human stopped the command, so don't start anything else
+	default:
+		followers = onFailure
+	}
+	for _, f := range followers {
+		f.Queue(TriggerDependency, run.Finished, nil)
+	}
+}
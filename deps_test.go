@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDependencyCycles(t *testing.T) {
+	importer := &Command{Name: "import", OnSuccess: []string{"reindex"}}
+	reindex := &Command{Name: "reindex"}
+	seed := &Command{Name: "seed", After: []string{"reindex"}}
+	cmds := []*Command{importer, reindex, seed}
+	if err := ResolveDependencies(cmds); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(importer.onSuccess) != 1 || importer.onSuccess[0] != reindex || len(seed.after) != 1 || seed.after[0] != reindex {
+		t.Fatalf("Dependencies not resolved")
+	}
+
+	// seed -> import closes the loop
+	seed.OnFailure = []string{"import"}
+	reindex.OnSuccess = []string{"bogus"}
+	importer.After = []string{"seed"}
+	err := ResolveDependencies(cmds)
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("Expected cycle to be detected, but got %v", err)
+	}
+	if importer.onSuccess != nil || seed.after != nil {
+		t.Errorf("Dependencies must not be linked when there is a cycle")
+	}
+
+	// A command that triggers itself is a cycle too
+	self := &Command{Name: "self", OnFailure: []string{"self"}}
+	if err := ResolveDependencies([]*Command{self}); err == nil {
+		t.Errorf("Expected self cycle to be detected")
+	}
+
+	// Unknown names are reported, but the rest is still linked
+	importer.After = nil
+	seed.OnFailure = nil
+	if err := ResolveDependencies(cmds); err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Errorf("Expected unknown command to be reported, but got %v", err)
+	}
+	if len(importer.onSuccess) != 1 {
+		t.Errorf("Valid dependencies must still be linked")
+	}
+
+	// A command that comes after an unknown command never runs, even if the others succeed
+	seed.After = []string{"reindex", "typo"}
+	if err := ResolveDependencies(cmds); err == nil || !strings.Contains(err.Error(), "typo") {
+		t.Errorf("Expected unknown command to be reported, but got %v", err)
+	}
+	reindex.lastSuccess = time.Now()
+	if seed.after != nil || !seed.dependenciesReady().IsZero() {
+		t.Errorf("After must not be linked when one of its commands is unknown")
+	}
+}
+
+func TestDependencyChain(t *testing.T) {
+	now := time.Date(2015, 07, 15, 2, 0, 0, 0, time.UTC)
+	importer := &Command{Name: "import", Pool: "db", Enabled: true, Interval: 24 * time.Hour, OnFailure: []string{"cleanup"}}
+	importer.SetStartTime(1, 0)
+	importer.lastRun = now.Add(-30 * time.Minute)
+	reindex := &Command{Name: "reindex", Pool: "db", Enabled: true, After: []string{"import"}, lastRun: now.Add(-24 * time.Hour)}
+	cleanup := &Command{Name: "cleanup", Pool: "other", Enabled: true, Interval: 24 * time.Hour, lastRun: now.Add(-time.Hour)}
+	cleanup.SetStartTime(12, 0)
+	cmds := []*Command{importer, reindex, cleanup}
+	if err := ResolveDependencies(cmds); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if reindex.MustRun(now) || NextRunnable(cmds, now) != nil {
+		t.Fatalf("Nothing should be runnable yet")
+	}
+
+	// import succeeds, which unblocks reindex
+	importer.lastSuccess = now.Add(-10 * time.Minute)
+	queueFollowers(&RunRecord{Outcome: OutcomeSuccess, Finished: importer.lastSuccess}, importer.onSuccess, importer.onFailure)
+	if next := NextRunnable(cmds, now); next != reindex {
+		t.Fatalf("Expected reindex to run after import, but got %v", next)
+	}
+	reindex.lastRun = now
+	if reindex.MustRun(now.Add(time.Hour)) {
+		t.Fatalf("reindex must only run once per import")
+	}
+
+	// import fails, which queues cleanup, outside of its normal schedule
+	queueFollowers(&RunRecord{Outcome: OutcomeFailure, Finished: now}, importer.onSuccess, importer.onFailure)
+	if next := NextRunnable(cmds, now); next != cleanup {
+		t.Fatalf("Expected cleanup to be queued after import failure, but got %v", next)
+	}
+	if trigger, _ := cleanup.takeQueued(); trigger != TriggerDependency || cleanup.MustRun(now) {
+		t.Fatalf("Queued trigger incorrect")
+	}
+}
@@ -0,0 +1,295 @@
+package scheduler
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+// Email alerts for failed runs.
+//
+// The first failure is mailed immediately. After that, failures for the same recipients are
+// collected into a digest, which is sent at most once per DigestInterval. A job that fails
+// every five minutes therefore sends one mail per interval, instead of hundreds.
+
+// How we connect to the SMTP server
+const (
+	SmtpPlain    = "none"     // No encryption
+	SmtpStartTls = "starttls" // Upgrade a plain connection with STARTTLS
+	SmtpTls      = "tls"      // Connect with TLS from the start (usually port 465)
+)
+
+// How much of stdout and stderr we put into a mail
+const emailOutputLimit = 4 * 1024
+
+// How long we wait for the SMTP server
+const smtpTimeout = 30 * time.Second
+
+// The SMTP server, and who we send mail as
+type SmtpSettings struct {
+	Host     string
+	Port     int
+	TLS      string // SmtpPlain, SmtpStartTls, or SmtpTls
+	Username string // If empty, then we don't authenticate
+	Password string
+	From     string
+}
+
+// Send mail to these recipients when a matching run fails
+type EmailRule struct {
+	To       []string
+	On       []NotifyCondition // Only NotifyFailure and NotifyTimeout are meaningful here
+	Commands []string          // If Commands and Pools are both empty, then the rule applies to all commands
+	Pools    []string
+}
+
+type Mailer struct {
+	Logger *log.Logger
+	Host   string // Our host name, which identifies the site in the subject line
+
+	lock     sync.Mutex
+	settings SmtpSettings
+	rules    []*EmailRule
+	interval time.Duration
+	digests  map[string]*emailDigest // Keyed by the sorted list of recipients
+	send     func(settings SmtpSettings, to []string, msg []byte) error
+}
+
+// Failures that are waiting to be mailed to a set of recipients
+type emailDigest struct {
+	to       []string
+	entries  map[string]*digestEntry // Keyed by command name
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+// The failures of one command in a digest
+type digestEntry struct {
+	command  string
+	pool     string
+	count    int
+	first    time.Time
+	outcomes map[Outcome]int
+	latest   *RunRecord
+}
+
+func NewMailer(logger *log.Logger) *Mailer {
+	host, _ := os.Hostname()
+	return &Mailer{
+		Logger:  logger,
+		Host:    host,
+		digests: map[string]*emailDigest{},
+		send:    sendSmtp,
+	}
+}
+
+// Change the settings and rules. Digests that are waiting to be sent, and the throttling
+// of each set of recipients, are not affected, so this can be called on every config reload.
+func (m *Mailer) Configure(settings SmtpSettings, rules []*EmailRule, digestInterval time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.settings = settings
+	m.rules = rules
+	m.interval = digestInterval
+}
+
+// Queue a mail for a finished run, if it failed and any rules match
+func (m *Mailer) RunFinished(run *RunRecord, pool string) {
+	condition := runCondition(run, nil)
+	if condition != NotifyFailure && condition != NotifyTimeout {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.settings.Host == "" {
+		return
+	}
+	recipients := map[string]bool{}
+	for _, r := range m.rules {
+		matchesCommand := (len(r.Commands) == 0 && len(r.Pools) == 0) || slices.Contains(r.Commands, run.Command) || slices.Contains(r.Pools, pool)
+		if matchesCommand && slices.Contains(r.On, condition) {
+			for _, to := range r.To {
+				recipients[to] = true
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	to := []string{}
+	for r := range recipients {
+		to = append(to, r)
+	}
+	sort.Strings(to)
+	key := strings.Join(to, ",")
+	d := m.digests[key]
+	if d == nil {
+		d = &emailDigest{to: to, entries: map[string]*digestEntry{}}
+		m.digests[key] = d
+	}
+	e := d.entries[run.Command]
+	if e == nil {
+		e = &digestEntry{command: run.Command, pool: pool, first: run.Finished, outcomes: map[Outcome]int{}}
+		d.entries[run.Command] = e
+	}
+	e.count++
+	e.outcomes[run.Outcome]++
+	e.latest = run
+
+	if d.timer != nil {
+		// A digest is already scheduled
+		return
+	}
+	wait := time.Until(d.lastSent.Add(m.interval))
+	if wait < 0 {
+		wait = 0
+	}
+	d.timer = time.AfterFunc(wait, func() { m.flush(key) })
+}
+
+// Send the digest for a set of recipients
+func (m *Mailer) flush(key string) {
+	m.lock.Lock()
+	d := m.digests[key]
+	entries := d.entries
+	d.entries = map[string]*digestEntry{}
+	d.timer = nil
+	d.lastSent = time.Now()
+	settings := m.settings
+	m.lock.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	msg := m.buildMessage(settings, d.to, entries)
+	if err := m.send(settings, d.to, msg); err != nil {
+		m.Logger.Errorf("Error sending failure mail to %v: %v", strings.Join(d.to, ", "), err)
+	}
+}
+
+func (m *Mailer) buildMessage(settings SmtpSettings, to []string, entries map[string]*digestEntry) []byte {
+	names := []string{}
+	runs := 0
+	for name, e := range entries {
+		names = append(names, name)
+		runs += e.count
+	}
+	sort.Strings(names)
+
+	subject := ""
+	if len(names) == 1 && runs == 1 {
+		subject = fmt.Sprintf("[%v] %v: %v", m.Host, names[0], entries[names[0]].latest.Outcome)
+	} else {
+		subject = fmt.Sprintf("[%v] %v failed runs of %v", m.Host, runs, strings.Join(names, ", "))
+	}
+
+	body := &strings.Builder{}
+	fmt.Fprintf(body, "The scheduler on %v had the following failures.\r\n", m.Host)
+	for _, name := range names {
+		e := entries[name]
+		outcomes := []string{}
+		for o, n := range e.outcomes {
+			outcomes = append(outcomes, fmt.Sprintf("%v: %v", o, n))
+		}
+		sort.Strings(outcomes)
+		run := e.latest
+		fmt.Fprintf(body, "\r\n=== %v ===\r\n", name)
+		if e.pool != "" {
+			fmt.Fprintf(body, "Pool:         %v\r\n", e.pool)
+		}
+		fmt.Fprintf(body, "Failures:     %v (%v), since %v\r\n", e.count, strings.Join(outcomes, ", "), e.first.Format(time.RFC1123))
+		fmt.Fprintf(body, "Latest run:   %v, started %v, took %.0f seconds\r\n", run.ID, run.Started.Format(time.RFC1123), run.Duration)
+		fmt.Fprintf(body, "Outcome:      %v (%v)\r\n", run.Outcome, describeExit(run))
+		if run.Error != "" {
+			fmt.Fprintf(body, "Error:        %v\r\n", run.Error)
+		}
+		if run.Stdout != "" {
+			fmt.Fprintf(body, "\r\n--- stdout (tail) ---\r\n%v\r\n", truncateOutput(run.Stdout, emailOutputLimit))
+		}
+		if run.Stderr != "" {
+			fmt.Fprintf(body, "\r\n--- stderr (tail) ---\r\n%v\r\n", truncateOutput(run.Stderr, emailOutputLimit))
+		}
+	}
+
+	msg := &strings.Builder{}
+	fmt.Fprintf(msg, "From: %v\r\n", settings.From)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	// Bare line feeds are not allowed in SMTP
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(msg.String())
+}
+
+func sendSmtp(settings SmtpSettings, to []string, msg []byte) error {
+	port := settings.Port
+	if port == 0 {
+		port = 25
+		if settings.TLS == SmtpTls {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	if settings.TLS == SmtpTls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, settings.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if settings.TLS == SmtpStartTls {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if settings.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(settings.From); err != nil {
+		return err
+	}
+	for _, r := range to {
+		if err := client.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+type sentMail struct {
+	to  []string
+	msg string
+}
+
+func newTestMailer(t *testing.T, interval time.Duration, rules []*EmailRule) (*Mailer, chan sentMail) {
+	sent := make(chan sentMail, 10)
+	m := NewMailer(log.NewTesting(t))
+	m.Host = "site1"
+	m.send = func(settings SmtpSettings, to []string, msg []byte) error {
+		sent <- sentMail{to, string(msg)}
+		return nil
+	}
+	m.Configure(SmtpSettings{Host: "mail.example.com", From: "scheduler@example.com"}, rules, interval)
+	return m, sent
+}
+
+func waitForMail(t *testing.T, sent chan sentMail) sentMail {
+	select {
+	case mail := <-sent:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Mail was not sent")
+	}
+	return sentMail{}
+}
+
+func TestMailerDigest(t *testing.T) {
+	interval := 300 * time.Millisecond
+	m, sent := newTestMailer(t, interval, []*EmailRule{
+		{To: []string{"ops@example.com"}, On: []NotifyCondition{NotifyFailure, NotifyTimeout}, Pools: []string{"imports"}},
+		{To: []string{"dba@example.com"}, On: []NotifyCondition{NotifyTimeout}, Commands: []string{"backup"}},
+	})
+
+	// None of these match a rule
+	m.RunFinished(&RunRecord{Command: "import", Outcome: OutcomeSuccess}, "imports")
+	m.RunFinished(&RunRecord{Command: "backup", Outcome: OutcomeFailure}, "")
+	m.RunFinished(&RunRecord{Command: "report", Outcome: OutcomeFailure}, "")
+
+	// The first failure is sent immediately
+	m.RunFinished(&RunRecord{ID: "r1", Command: "import", Outcome: OutcomeFailure, ExitCode: 2, Stdout: "reading file", Stderr: "file not found"}, "imports")
+	mail := waitForMail(t, sent)
+	if len(mail.to) != 1 || mail.to[0] != "ops@example.com" {
+		t.Errorf("Mail sent to wrong recipients: %v", mail.to)
+	}
+	for _, expect := range []string{"Subject: [site1] import: failure\r\n", "From: scheduler@example.com\r\n", "Pool:         imports", "file not found", "reading file"} {
+		if !strings.Contains(mail.msg, expect) {
+			t.Errorf("Expected mail to contain %q, but it is:\n%v", expect, mail.msg)
+		}
+	}
+
+	// A flapping job is collected into a single digest
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		m.RunFinished(&RunRecord{Command: "import", Outcome: OutcomeFailure, Stderr: "attempt failed"}, "imports")
+	}
+	m.RunFinished(&RunRecord{ID: "r30", Command: "import", Outcome: OutcomeTimeout}, "imports")
+	select {
+	case mail := <-sent:
+		t.Fatalf("Mail sent before the digest interval: %v", mail.msg)
+	case <-time.After(interval / 3):
+	}
+	mail = waitForMail(t, sent)
+	if time.Since(start) < interval/2 {
+		t.Errorf("Digest was sent too soon")
+	}
+	for _, expect := range []string{"Subject: [site1] 21 failed runs of import\r\n", "21 (failure: 20, timeout: 1)", "Latest run:   r30"} {
+		if !strings.Contains(mail.msg, expect) {
+			t.Errorf("Expected digest to contain %q, but it is:\n%v", expect, mail.msg)
+		}
+	}
+	if strings.Contains(strings.ReplaceAll(mail.msg, "\r\n", ""), "\n") {
+		t.Errorf("Mail contains bare line feeds")
+	}
+}
+
+func TestMailerRecipients(t *testing.T) {
+	m, sent := newTestMailer(t, time.Hour, []*EmailRule{
+		{To: []string{"ops@example.com"}, On: []NotifyCondition{NotifyTimeout}},
+		{To: []string{"dba@example.com", "ops@example.com"}, On: []NotifyCondition{NotifyTimeout}, Commands: []string{"backup"}},
+	})
+	m.RunFinished(&RunRecord{Command: "backup", Outcome: OutcomeTimeout}, "")
+	mail := waitForMail(t, sent)
+	if strings.Join(mail.to, ",") != "dba@example.com,ops@example.com" {
+		t.Errorf("Mail sent to wrong recipients: %v", mail.to)
+	}
+	// A different set of recipients has its own throttling
+	m.RunFinished(&RunRecord{Command: "import", Outcome: OutcomeTimeout}, "")
+	mail = waitForMail(t, sent)
+	if strings.Join(mail.to, ",") != "ops@example.com" {
+		t.Errorf("Mail sent to wrong recipients: %v", mail.to)
+	}
+
+	// Without a mail server, nothing is sent
+	m.Configure(SmtpSettings{}, m.rules, time.Hour)
+	m.RunFinished(&RunRecord{Command: "report", Outcome: OutcomeTimeout}, "")
+	if len(m.digests) != 2 {
+		t.Errorf("Expected no new digest, but have %v", len(m.digests))
+	}
+}
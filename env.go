@@ -0,0 +1,31 @@
+package scheduler
+
+import (
+	"os"
+	"sort"
+)
+
+// Build the environment for a command's process.
+// If inherit is true, then the process starts with the scheduler's environment, and env is overlaid on top.
+// Variables are substituted into the values of env.
+// A nil result means "inherit the scheduler's environment as is", which is what exec.Cmd does with a nil Env.
+func buildEnvironment(env map[string]string, inherit bool, variables map[string]string) []string {
+	if inherit && len(env) == 0 {
+		return nil
+	}
+	result := []string{}
+	if inherit {
+		result = append(result, os.Environ()...)
+	}
+	keys := []string{}
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// exec.Cmd removes duplicates from Env, keeping the last value, so these override anything we've inherited.
+	// On Windows, the duplicate check is case insensitive.
+	for _, k := range keys {
+		result = append(result, k+"="+substitute_variables(env[k], variables))
+	}
+	return result
+}
@@ -0,0 +1,28 @@
+package scheduler
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBuildEnvironment(t *testing.T) {
+	variables := map[string]string{"VAR_DIR": `c:\imqsvar`}
+	if env := buildEnvironment(nil, true, variables); env != nil {
+		t.Errorf("Expected nil environment when inheriting without overrides")
+	}
+	if env := buildEnvironment(nil, false, variables); env == nil || len(env) != 0 {
+		t.Errorf("Expected empty environment when not inheriting")
+	}
+
+	env := buildEnvironment(map[string]string{"PGPASSFILE": `!VAR_DIR\pgpass.conf`, "A": "1"}, false, variables)
+	expected := []string{"A=1", `PGPASSFILE=c:\imqsvar\pgpass.conf`}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %q, but got %q", expected, env)
+	}
+
+	env = buildEnvironment(map[string]string{"A": "1"}, true, variables)
+	if len(env) != len(os.Environ())+1 || env[len(env)-1] != "A=1" {
+		t.Errorf("Overrides must come after the inherited environment")
+	}
+}
@@ -0,0 +1,101 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// The kind of thing that happened
+type EventType string
+
+const (
+	EventStarted        EventType = "started"
+	EventFinished       EventType = "finished"
+	EventTimedOut       EventType = "timed-out"
+	EventPoolBusy       EventType = "pool-busy"     // The command is due, but must wait for its pool
+	EventWindowMissed   EventType = "window-missed" // The command did not start within the window of its scheduled time, so it was skipped
+	EventConfigReloaded EventType = "config-reloaded"
+	EventEnabled        EventType = "enabled"
+	EventDisabled       EventType = "disabled"
+)
+
+// Something that happened in the scheduler
+type Event struct {
+	ID       int64 // Increases by one with every event, so that a subscriber can tell if it missed any
+	Type     EventType
+	Time     time.Time
+	Command  string  `json:",omitempty"`
+	Pool     string  `json:",omitempty"`
+	RunID    string  `json:",omitempty"`
+	Trigger  Trigger `json:",omitempty"`
+	Outcome  Outcome `json:",omitempty"`
+	Duration float64 `json:",omitempty"` // Seconds
+	Message  string  `json:",omitempty"`
+}
+
+// How many events a subscriber may fall behind before it starts missing events
+const eventSubscriberBuffer = 100
+
+// How many recent events we keep, for subscribers that reconnect
+const eventHistorySize = 100
+
+// Delivers events to subscribers. Publishing never blocks, so a slow subscriber
+// misses events, instead of holding up the scheduler.
+type EventBus struct {
+	lock        sync.Mutex
+	nextID      int64
+	recent      []Event
+	subscribers map[chan Event]bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		nextID:      1,
+		subscribers: map[chan Event]bool{},
+	}
+}
+
+// Send an event to all subscribers. The ID and Time of the event are filled in.
+func (b *EventBus) Publish(e Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e.ID = b.nextID
+	b.nextID++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventHistorySize {
+		b.recent = b.recent[len(b.recent)-eventHistorySize:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe to events. Recent events with an ID greater than afterID are delivered first,
+// so a subscriber that reconnects can pick up where it left off. Pass an afterID of -1 to
+// receive only new events. The caller must call Unsubscribe when it is done.
+func (b *EventBus) Subscribe(afterID int64) chan Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ch := make(chan Event, eventSubscriberBuffer+eventHistorySize)
+	if afterID >= 0 {
+		for _, e := range b.recent {
+			if e.ID > afterID {
+				ch <- e
+			}
+		}
+	}
+	b.subscribers[ch] = true
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, ch)
+}
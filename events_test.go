@@ -0,0 +1,100 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	b := NewEventBus()
+	b.Publish(Event{Type: EventConfigReloaded})
+	ch := b.Subscribe(-1)
+	b.Publish(Event{Type: EventStarted, Command: "import"})
+	if e := <-ch; e.Type != EventStarted || e.ID != 2 || e.Time.IsZero() {
+		t.Errorf("Event incorrect: %+v", e)
+	}
+
+	// A subscriber that reconnects receives the events that it missed
+	replay := b.Subscribe(0)
+	if e := <-replay; e.ID != 1 {
+		t.Errorf("Expected replay to start at event 1, but got %v", e.ID)
+	}
+	if e := <-replay; e.ID != 2 {
+		t.Errorf("Expected replay of event 2, but got %v", e.ID)
+	}
+	b.Unsubscribe(replay)
+
+	// Publishing never blocks on a subscriber that isn't reading
+	for i := 0; i < 10*eventSubscriberBuffer; i++ {
+		b.Publish(Event{Type: EventFinished})
+	}
+	if len(b.recent) != eventHistorySize {
+		t.Errorf("Expected %v recent events, but have %v", eventHistorySize, len(b.recent))
+	}
+	b.Unsubscribe(ch)
+}
+
+func TestMissedWindow(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+	watching := nowPresent.Add(-48 * time.Hour)
+
+	daily := &Command{Enabled: true, Interval: 24 * time.Hour, lastRun: nowPresent.Add(-26 * time.Hour)}
+	daily.SetStartTime(2, 0)
+	start := time.Date(2015, 07, 15, 2, 0, 0, 0, loc)
+	if missed := daily.MissedWindow(nowPresent, watching); !missed.Equal(start) {
+		t.Errorf("Expected daily task to miss %v, but got %v", start, missed)
+	}
+	if missed := daily.MissedWindow(start.Add(time.Hour), watching); !missed.IsZero() {
+		t.Errorf("Window is still open, but got %v", missed)
+	}
+	daily.lastRun = start.Add(30 * time.Minute)
+	if missed := daily.MissedWindow(nowPresent, watching); !missed.IsZero() {
+		t.Errorf("Daily task ran within its window, but got %v", missed)
+	}
+	daily.lastRun = time.Time{}
+	if missed := daily.MissedWindow(nowPresent, watching); !missed.Equal(start.Add(-24 * time.Hour)) {
+		t.Errorf("Expected task that has never run to miss the first window after we started watching it, but got %v", missed)
+	}
+	// We started watching the task after its window opened, eg because the scheduler was restarted
+	if missed := daily.MissedWindow(nowPresent, start.Add(time.Minute)); !missed.IsZero() {
+		t.Errorf("Task that has never run must not miss a window that opened before we watched it, but got %v", missed)
+	}
+	daily.Enabled = false
+	if missed := daily.MissedWindow(nowPresent, watching); !missed.IsZero() {
+		t.Errorf("Disabled task must never miss its window, but got %v", missed)
+	}
+
+	cron, _ := ParseCron("0 1 * * *")
+	nightly := &Command{Enabled: true, Cron: cron, lastRun: nowPresent.Add(-26 * time.Hour)}
+	now := time.Date(2015, 07, 15, 3, 30, 0, 0, loc)
+	if missed := nightly.MissedWindow(now, watching); !missed.Equal(time.Date(2015, 07, 15, 1, 0, 0, 0, loc)) {
+		t.Errorf("Expected cron task to miss 01:00, but got %v", missed)
+	}
+	fresh := &Command{Enabled: true, Cron: cron}
+	if missed := fresh.MissedWindow(now, now.Add(-time.Minute)); !missed.IsZero() {
+		t.Errorf("New cron task must not report a window that opened before we watched it, but got %v", missed)
+	}
+	interval := &Command{Enabled: true, Interval: time.Hour}
+	if missed := interval.MissedWindow(nowPresent, watching); !missed.IsZero() {
+		t.Errorf("Interval tasks have no window, but got %v", missed)
+	}
+
+	// A task that is held up for 8 hours misses one window, not one for every activation
+	frequent, _ := ParseCron("*/15 * * * *")
+	held := &Command{Enabled: true, Cron: frequent, lastRun: now}
+	reported := map[time.Time]bool{}
+	for at := now; at.Before(now.Add(8 * time.Hour)); at = at.Add(time.Minute) {
+		if missed := held.MissedWindow(at, watching); !missed.IsZero() {
+			reported[missed] = true
+		}
+	}
+	if len(reported) != 1 || !reported[time.Date(2015, 07, 15, 3, 45, 0, 0, loc)] {
+		t.Errorf("Expected one missed window at 03:45, but got %v", reported)
+	}
+	// A running task hasn't missed anything yet
+	held.isRunningAtomic = 1
+	if missed := held.MissedWindow(now.Add(8*time.Hour), watching); !missed.IsZero() {
+		t.Errorf("Running task must not miss its window, but got %v", missed)
+	}
+}
@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Returns true if the run did its job. A warning counts as success, so that it
+// updates the last success time, and triggers OnSuccess commands.
+func (o Outcome) Succeeded() bool {
+	return o == OutcomeSuccess || o == OutcomeWarning
+}
+
+// Parse an outcome that may be assigned to an exit code: "success", "warning", or "failure"
+func ParseExitOutcome(s string) (Outcome, error) {
+	switch o := Outcome(strings.ToLower(strings.TrimSpace(s))); o {
+	case OutcomeSuccess, OutcomeWarning, OutcomeFailure:
+		return o, nil
+	}
+	return "", fmt.Errorf("Invalid exit code outcome '%v'. Must be success, warning, or failure", s)
+}
+
+// Decide the outcome of a process that exited by itself.
+// Exit codes that are not listed in ExitCodes follow the usual convention, where zero is success.
+func (c *Command) classifyExit(code int) Outcome {
+	if o, ok := c.ExitCodes[code]; ok {
+		return o
+	}
+	if code == 0 {
+		return OutcomeSuccess
+	}
+	return OutcomeFailure
+}
+
+// Fill in the exit code, signal, and error of a process that has finished.
+// waitErr is the error returned by Wait.
+func recordExitStatus(run *RunRecord, state *os.ProcessState, waitErr error) {
+	if state != nil {
+		run.ExitCode = state.ExitCode()
+		run.Signal = exitSignal(state)
+	}
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		// Something other than a non-zero exit, such as a failure to copy the process's output
+		run.Error = waitErr.Error()
+	}
+}
+
+// Describe how a process exited, for our logs
+func describeExit(run *RunRecord) string {
+	if run.Signal != "" {
+		return "killed by signal " + run.Signal
+	}
+	return fmt.Sprintf("exit code %v", run.ExitCode)
+}
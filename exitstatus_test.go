@@ -0,0 +1,71 @@
+package scheduler
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestClassifyExit(t *testing.T) {
+	c := &Command{
+		ExitCodes: map[int]Outcome{
+			0: OutcomeFailure,
+			2: OutcomeSuccess,
+			3: OutcomeWarning,
+		},
+	}
+	expect := map[int]Outcome{
+		0: OutcomeFailure,
+		1: OutcomeFailure,
+		2: OutcomeSuccess,
+		3: OutcomeWarning,
+	}
+	for code, outcome := range expect {
+		if o := c.classifyExit(code); o != outcome {
+			t.Errorf("Exit code %v: expected %v, but got %v", code, outcome, o)
+		}
+	}
+	if o := (&Command{}).classifyExit(0); o != OutcomeSuccess {
+		t.Errorf("Exit code 0 must be success by default, but got %v", o)
+	}
+
+	if o, err := ParseExitOutcome(" Warning "); err != nil || o != OutcomeWarning {
+		t.Errorf("Failed to parse warning: %v %v", o, err)
+	}
+	if _, err := ParseExitOutcome("timeout"); err == nil {
+		t.Errorf("Expected timeout to be rejected as an exit code outcome")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on sh")
+	}
+	c := &Command{
+		Name:      "warn",
+		Exec:      "sh",
+		Params:    []string{"-c", "exit 3"},
+		Timeout:   10 * time.Second,
+		ExitCodes: map[int]Outcome{3: OutcomeWarning},
+	}
+	run := waitForRun(t, startCommand(t, c))
+	if run.Outcome != OutcomeWarning || run.ExitCode != 3 || run.Signal != "" {
+		t.Errorf("Expected warning with exit code 3, but got %v %v %v", run.Outcome, run.ExitCode, run.Signal)
+	}
+	if c.lastSuccess.IsZero() {
+		t.Errorf("A warning must count as a success")
+	}
+
+	// A process that kills itself. Even though its exit code is -1, it must not be classified by exit code.
+	c = &Command{
+		Name:      "signal",
+		Exec:      "sh",
+		Params:    []string{"-c", "kill -TERM $$"},
+		Timeout:   10 * time.Second,
+		ExitCodes: map[int]Outcome{-1: OutcomeSuccess},
+	}
+	run = waitForRun(t, startCommand(t, c))
+	if run.Outcome != OutcomeFailure || run.Signal != "terminated" {
+		t.Errorf("Expected failure by signal, but got %v %q", run.Outcome, run.Signal)
+	}
+}
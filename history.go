@@ -0,0 +1,233 @@
+package scheduler
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// What caused a command to run
+type Trigger string
+
+const (
+	TriggerSchedule   Trigger = "schedule"
+	TriggerHttp       Trigger = "http"
+	TriggerRetry      Trigger = "retry"
+	TriggerDependency Trigger = "dependency"
+)
+
+// How a run ended
+type Outcome string
+
+const (
+	OutcomeSuccess      Outcome = "success"
+	OutcomeWarning      Outcome = "warning" // The process exited with a code that is configured as a warning
+	OutcomeFailure      Outcome = "failure"
+	OutcomeTimeout      Outcome = "timeout"
+	OutcomeStartFailure Outcome = "start-failure"
+	OutcomeCancelled    Outcome = "cancelled"
+)
+
+// We only keep the tail of stdout and stderr in the history, because that's
+// usually where the interesting part is.
+const historyOutputLimit = 8 * 1024
+
+// A single run of a command
+type RunRecord struct {
+	ID          string
+	Command     string
+	Trigger     Trigger
+	Attempt     int // 1 for the first run, 2 for the first retry, etc
+	Started     time.Time
+	Finished    time.Time
+	Duration    float64 // Seconds
+	ExitCode    int     // -1 if the process did not exit by itself
+	Signal      string  `json:",omitempty"` // The signal that terminated the process, if any. Always empty on Windows.
+	Outcome     Outcome
+	Termination Termination `json:",omitempty"` // How we stopped the process, if it timed out or was cancelled
+	Error       string      `json:",omitempty"`
+	Stdout      string      `json:",omitempty"` // The tail of stdout
+	Stderr      string      `json:",omitempty"` // The tail of stderr
+	OutputFile  string      `json:",omitempty"` // The file that holds the complete output of the run, up to its size limit
+}
+
+// The run history is stored as an append-only file, with one JSON object per line.
+// When the file grows beyond its retention limits, we rewrite it with only the
+// records that we want to keep.
+type History struct {
+	Filename  string
+	maxRuns   int
+	maxAge    time.Duration
+	lock      sync.Mutex
+	records   []*RunRecord // oldest first
+	numInFile int          // number of records in the file, which can be more than len(records)
+}
+
+// Open the history file, creating it if necessary.
+// maxRuns and maxAge are the retention limits. Zero means no limit.
+func OpenHistory(filename string, maxRuns int, maxAge time.Duration) (*History, error) {
+	h := &History{
+		Filename: filename,
+		maxRuns:  maxRuns,
+		maxAge:   maxAge,
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return h, nil
+	} else if err != nil {
+		return h, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		r := &RunRecord{}
+		// Skip corrupt lines, such as a partial write from a power failure
+		if json.Unmarshal(scanner.Bytes(), r) == nil {
+			h.records = append(h.records, r)
+		}
+		h.numInFile++
+	}
+	h.prune(time.Now())
+	return h, scanner.Err()
+}
+
+// Change the retention limits
+func (h *History) SetRetention(maxRuns int, maxAge time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.maxRuns = maxRuns
+	h.maxAge = maxAge
+}
+
+// Add a record to the history
+func (h *History) Add(r *RunRecord) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	cp := *r
+	h.records = append(h.records, &cp)
+	h.prune(time.Now())
+	// Allow the file to grow somewhat beyond what we keep in memory before we rewrite it
+	if h.numInFile >= len(h.records)+len(h.records)/4+100 {
+		return h.rewrite()
+	}
+	return h.append(&cp)
+}
+
+// Returns the most recent runs, newest first.
+// If command is not empty, then only runs of that command are returned.
+// If limit is zero, then all runs are returned.
+func (h *History) Recent(command string, limit int) []RunRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	result := []RunRecord{}
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		if command == "" || h.records[i].Command == command {
+			result = append(result, *h.records[i])
+		}
+	}
+	return result
+}
+
+// Returns the run with the given ID, or nil if it is not in the history
+func (h *History) Get(id string) *RunRecord {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i := len(h.records) - 1; i >= 0; i-- {
+		if h.records[i].ID == id {
+			cp := *h.records[i]
+			return &cp
+		}
+	}
+	return nil
+}
+
+// Drop records that are beyond our retention limits. Only the in-memory list is affected.
+func (h *History) prune(now time.Time) {
+	drop := 0
+	if h.maxRuns > 0 && len(h.records) > h.maxRuns {
+		drop = len(h.records) - h.maxRuns
+	}
+	if h.maxAge > 0 {
+		for drop < len(h.records) && now.Sub(h.records[drop].Started) > h.maxAge {
+			drop++
+		}
+	}
+	h.records = h.records[drop:]
+}
+
+func (h *History) append(r *RunRecord) error {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.Filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	h.numInFile++
+	return nil
+}
+
+func (h *History) rewrite() error {
+	if err := os.MkdirAll(filepath.Dir(h.Filename), 0755); err != nil {
+		return err
+	}
+	tmp := h.Filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range h.records {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(raw)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.Filename); err != nil {
+		return err
+	}
+	h.numInFile = len(h.records)
+	return nil
+}
+
+// Produce a unique run ID, which sorts by start time
+func newRunID(now time.Time) string {
+	var b [4]byte
+	rand.Read(b[:])
+	return now.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// Keep only the tail of a job's output
+func truncateOutput(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	return "...(truncated)...\n" + s[len(s)-limit:]
+}
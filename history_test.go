@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := OpenHistory(filename, 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to open history: %v", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 200; i++ {
+		cmd := "import"
+		if i%2 == 0 {
+			cmd = "backup"
+		}
+		r := &RunRecord{
+			ID:      fmt.Sprintf("run-%v", i),
+			Command: cmd,
+			Started: start.Add(time.Duration(i) * time.Second),
+			Outcome: OutcomeSuccess,
+		}
+		if err := h.Add(r); err != nil {
+			t.Fatalf("Failed to add run: %v", err)
+		}
+	}
+
+	recent := h.Recent("", 0)
+	if len(recent) != 10 || recent[0].ID != "run-199" || recent[9].ID != "run-190" {
+		t.Fatalf("Retention by count incorrect: %v", recent)
+	}
+	if backups := h.Recent("backup", 2); len(backups) != 2 || backups[0].ID != "run-198" || backups[1].ID != "run-196" {
+		t.Errorf("Filter by command incorrect: %v", backups)
+	}
+	if h.Get("run-195") == nil || h.Get("run-5") != nil {
+		t.Errorf("Get incorrect")
+	}
+
+	// Reopen, and make sure we see the same thing
+	h, err = OpenHistory(filename, 10, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen history: %v", err)
+	}
+	if reopened := h.Recent("", 0); len(reopened) != 10 || reopened[0].ID != "run-199" {
+		t.Fatalf("Reopened history incorrect: %v", reopened)
+	}
+	if h.numInFile > 10+10/4+100 {
+		t.Errorf("History file was not compacted: %v records", h.numInFile)
+	}
+
+	// Retention by age
+	h.SetRetention(0, 30*time.Minute)
+	h.Add(&RunRecord{ID: "new", Started: time.Now()})
+	if recent := h.Recent("", 0); len(recent) != 1 || recent[0].ID != "new" {
+		t.Errorf("Retention by age incorrect: %v", recent)
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	if truncateOutput("hello", 10) != "hello" {
+		t.Errorf("Short output must not be truncated")
+	}
+	if s := truncateOutput("hello world", 5); !strings.HasSuffix(s, "world") || !strings.Contains(s, "truncated") {
+		t.Errorf("Truncated output incorrect: %v", s)
+	}
+}
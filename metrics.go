@@ -0,0 +1,188 @@
+package scheduler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format.
+// Counters live here, and are reset when the scheduler restarts, which Prometheus handles.
+// Gauges are read from the commands at the time of the scrape.
+type Metrics struct {
+	lock          sync.Mutex
+	runs          map[runKey]int64
+	durations     map[string]*histogram
+	configReloads int64
+	configErrors  int64
+}
+
+type runKey struct {
+	command string
+	outcome Outcome
+}
+
+type histogram struct {
+	counts []int64 // One for each bucket in durationBuckets, plus one for +Inf
+	sum    float64
+	count  int64
+}
+
+// Buckets of run duration, in seconds. Our jobs range from a few seconds to a few hours.
+var durationBuckets = []float64{1, 5, 15, 60, 300, 900, 1800, 3600, 7200, 14400}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		runs:      map[runKey]int64{},
+		durations: map[string]*histogram{},
+	}
+}
+
+// Record a finished run
+func (m *Metrics) RecordRun(run *RunRecord) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.runs[runKey{run.Command, run.Outcome}]++
+	h := m.durations[run.Command]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(durationBuckets)+1)}
+		m.durations[run.Command] = h
+	}
+	i := sort.SearchFloat64s(durationBuckets, run.Duration)
+	h.counts[i]++
+	h.sum += run.Duration
+	h.count++
+}
+
+// Record a change of config
+func (m *Metrics) RecordConfigReload() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.configReloads++
+}
+
+// Record a config file that could not be loaded
+func (m *Metrics) RecordConfigError() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.configErrors++
+}
+
+// Write all metrics. The caller must ensure that cmd is not modified while we read it.
+func (m *Metrics) Write(w io.Writer, cmd []*Command, now time.Time) error {
+	b := bufio.NewWriter(w)
+	sorted := append([]*Command{}, cmd...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	m.lock.Lock()
+	writeHeader(b, "scheduler_runs_total", "counter", "Number of finished runs, by outcome")
+	keys := []runKey{}
+	for k := range m.runs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	for _, k := range keys {
+		fmt.Fprintf(b, "scheduler_runs_total{command=%v,outcome=%v} %v\n", labelValue(k.command), labelValue(string(k.outcome)), m.runs[k])
+	}
+
+	writeHeader(b, "scheduler_run_duration_seconds", "histogram", "Duration of finished runs")
+	names := []string{}
+	for name := range m.durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := m.durations[name]
+		cumulative := int64(0)
+		for i, le := range durationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "scheduler_run_duration_seconds_bucket{command=%v,le=\"%v\"} %v\n", labelValue(name), formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(b, "scheduler_run_duration_seconds_bucket{command=%v,le=\"+Inf\"} %v\n", labelValue(name), h.count)
+		fmt.Fprintf(b, "scheduler_run_duration_seconds_sum{command=%v} %v\n", labelValue(name), formatFloat(h.sum))
+		fmt.Fprintf(b, "scheduler_run_duration_seconds_count{command=%v} %v\n", labelValue(name), h.count)
+	}
+
+	writeHeader(b, "scheduler_config_reloads_total", "counter", "Number of times that a changed config was loaded")
+	fmt.Fprintf(b, "scheduler_config_reloads_total %v\n", m.configReloads)
+	writeHeader(b, "scheduler_config_reload_errors_total", "counter", "Number of times that a config file could not be loaded")
+	fmt.Fprintf(b, "scheduler_config_reload_errors_total %v\n", m.configErrors)
+	m.lock.Unlock()
+
+	writeHeader(b, "scheduler_last_success_timestamp_seconds", "gauge", "Unix time of the last successful run. Zero if the command has never succeeded.")
+	for _, c := range sorted {
+		ts := 0.0
+		if lastSuccess := c.LastSuccess(); !lastSuccess.IsZero() {
+			ts = float64(lastSuccess.UnixNano()) / 1e9
+		}
+		fmt.Fprintf(b, "scheduler_last_success_timestamp_seconds{command=%v} %v\n", labelValue(c.Name), formatFloat(ts))
+	}
+
+	writeHeader(b, "scheduler_running", "gauge", "1 if the command is running")
+	for _, c := range sorted {
+		running := 0
+		if c.IsRunning() {
+			running = 1
+		}
+		fmt.Fprintf(b, "scheduler_running{command=%v,pool=%v} %v\n", labelValue(c.Name), labelValue(c.Pool), running)
+	}
+
+	// Disabled and running commands are never overdue, otherwise a disabled command would alert forever
+	writeHeader(b, "scheduler_overdue_seconds", "gauge", "How long an enabled command has been waiting to run, beyond the time that it was due")
+	for _, c := range sorted {
+		overdue := 0.0
+		if c.Enabled && !c.IsRunning() {
+			overdue = math.Max(0, c.timeOverdue(now).Seconds())
+		}
+		fmt.Fprintf(b, "scheduler_overdue_seconds{command=%v} %v\n", labelValue(c.Name), formatFloat(overdue))
+	}
+
+	// A command that must run, but is not running, is waiting for its pool
+	writeHeader(b, "scheduler_pool_queue_depth", "gauge", "Number of commands that are waiting for the pool to have capacity")
+	depth := map[string]int{}
+	for _, c := range sorted {
+		if _, ok := depth[c.Pool]; !ok {
+			depth[c.Pool] = 0
+		}
+		if !c.IsRunning() && c.MustRun(now) {
+			depth[c.Pool]++
+		}
+	}
+	pools := []string{}
+	for pool := range depth {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		fmt.Fprintf(b, "scheduler_pool_queue_depth{pool=%v} %v\n", labelValue(pool), depth[pool])
+	}
+
+	return b.Flush()
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// Quote and escape a label value
+func labelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + v + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 5, 3, 20, 0, loc)
+	importer := &Command{Name: "import", Pool: "db", Enabled: true, Interval: time.Hour, lastRun: nowPresent.Add(-3 * time.Hour)}
+	backup := &Command{Name: "backup", Pool: "db", Enabled: true, Interval: time.Hour, lastRun: nowPresent.Add(-2 * time.Hour)}
+	disabled := &Command{Name: "old", Interval: time.Hour}
+	importer.isRunningAtomic = 1
+	importer.lastSuccess = time.Unix(1436929400, 0)
+
+	m := NewMetrics()
+	m.RecordRun(&RunRecord{Command: "import", Outcome: OutcomeSuccess, Duration: 3})
+	m.RecordRun(&RunRecord{Command: "import", Outcome: OutcomeSuccess, Duration: 100})
+	m.RecordRun(&RunRecord{Command: "import", Outcome: OutcomeFailure, Duration: 20000})
+	m.RecordConfigReload()
+	m.RecordConfigError()
+
+	var buf bytes.Buffer
+	if err := m.Write(&buf, []*Command{importer, backup, disabled}, nowPresent); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+	out := buf.String()
+	expect := []string{
+		`scheduler_runs_total{command="import",outcome="success"} 2`,
+		`scheduler_runs_total{command="import",outcome="failure"} 1`,
+		`scheduler_run_duration_seconds_bucket{command="import",le="1"} 0`,
+		`scheduler_run_duration_seconds_bucket{command="import",le="5"} 1`,
+		`scheduler_run_duration_seconds_bucket{command="import",le="300"} 2`,
+		`scheduler_run_duration_seconds_bucket{command="import",le="14400"} 2`,
+		`scheduler_run_duration_seconds_bucket{command="import",le="+Inf"} 3`,
+		`scheduler_run_duration_seconds_sum{command="import"} 20103`,
+		`scheduler_run_duration_seconds_count{command="import"} 3`,
+		`scheduler_config_reloads_total 1`,
+		`scheduler_config_reload_errors_total 1`,
+		`scheduler_last_success_timestamp_seconds{command="import"} 1436929400`,
+		`scheduler_last_success_timestamp_seconds{command="backup"} 0`,
+		`scheduler_running{command="import",pool="db"} 1`,
+		`scheduler_running{command="backup",pool="db"} 0`,
+		`scheduler_overdue_seconds{command="backup"} 3600`,
+		`scheduler_overdue_seconds{command="import"} 0`,
+		`scheduler_overdue_seconds{command="old"} 0`,
+		`scheduler_pool_queue_depth{pool="db"} 1`,
+		`scheduler_pool_queue_depth{pool=""} 0`,
+		`# TYPE scheduler_run_duration_seconds histogram`,
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("Expected %v in metrics:\n%v", e, out)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	if v := labelValue("a\"b\\c\nd"); v != `"a\"b\\c\nd"` {
+		t.Errorf("Label escaping incorrect: %v", v)
+	}
+}
@@ -0,0 +1,195 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+// When to send a notification
+type NotifyCondition string
+
+const (
+	NotifyFailure      NotifyCondition = "failure"       // The process failed, or could not be started
+	NotifyTimeout      NotifyCondition = "timeout"       // The process timed out
+	NotifyRecovery     NotifyCondition = "recovery"      // The process succeeded, after its previous run did not
+	NotifyWindowMissed NotifyCondition = "window-missed" // A daily or cron task did not start within its window
+)
+
+// What we tell the outside world. This is the JSON payload of a webhook, and the data
+// of a webhook's body template.
+type Notification struct {
+	Condition NotifyCondition
+	Command   string
+	Host      string
+	Time      time.Time
+	Run       *RunRecord `json:",omitempty"` // Nil for a missed window
+	Scheduled time.Time  `json:",omitempty"` // The scheduled time of a missed window
+}
+
+// POST a notification to one or more URLs, when one of its conditions is met
+type WebhookRule struct {
+	On          []NotifyCondition
+	Commands    []string // If empty, then the rule applies to all commands
+	URLs        []string
+	Body        *template.Template // If nil, then the body is the Notification as JSON
+	ContentType string             // Defaults to application/json
+	Headers     map[string]string
+	MaxAttempts int           // Number of times to try each URL. Values less than 1 are treated as 1.
+	RetryDelay  time.Duration // Delay before the first retry. This doubles with every retry.
+}
+
+// Sends webhooks. Sending happens in the background, so a slow or dead endpoint never holds up the scheduler.
+type Notifier struct {
+	Rules  []*WebhookRule
+	Client *http.Client
+	Logger *log.Logger
+	Host   string
+}
+
+// How long we wait for a webhook endpoint to respond
+const webhookTimeout = 10 * time.Second
+
+func NewNotifier(logger *log.Logger, rules []*WebhookRule) *Notifier {
+	host, _ := os.Hostname()
+	return &Notifier{
+		Rules:  rules,
+		Client: &http.Client{Timeout: webhookTimeout},
+		Logger: logger,
+		Host:   host,
+	}
+}
+
+// Parse a notification condition, such as "failure" or "recovery"
+func ParseNotifyCondition(s string) (NotifyCondition, error) {
+	switch c := NotifyCondition(strings.ToLower(strings.TrimSpace(s))); c {
+	case NotifyFailure, NotifyTimeout, NotifyRecovery, NotifyWindowMissed:
+		return c, nil
+	}
+	return "", fmt.Errorf("Invalid notification condition '%v'. Must be failure, timeout, recovery, or window-missed", s)
+}
+
+// Parse the body template of a webhook. Besides the standard template functions, 'json'
+// encodes a value as JSON, which is the safe way to put a string into a JSON body.
+func ParseWebhookTemplate(body string) (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			raw, err := json.Marshal(v)
+			return string(raw), err
+		},
+	}).Parse(body)
+}
+
+// Decide which condition, if any, a finished run meets.
+// previous is the run before this one, or nil if there is none.
+func runCondition(run, previous *RunRecord) NotifyCondition {
+	switch {
+	case run.Outcome == OutcomeFailure || run.Outcome == OutcomeStartFailure:
+		return NotifyFailure
+	case run.Outcome == OutcomeTimeout:
+		return NotifyTimeout
+	case run.Outcome.Succeeded() && previous != nil && !previous.Outcome.Succeeded() && previous.Outcome != OutcomeCancelled:
+		return NotifyRecovery
+	}
+	return ""
+}
+
+// Send notifications for a finished run. previous is the run before this one, or nil if there is none.
+func (n *Notifier) RunFinished(run, previous *RunRecord) {
+	if condition := runCondition(run, previous); condition != "" {
+		n.notify(&Notification{
+			Condition: condition,
+			Command:   run.Command,
+			Time:      run.Finished,
+			Run:       run,
+		})
+	}
+}
+
+// Send notifications for a command that missed the start window of its scheduled run
+func (n *Notifier) WindowMissed(command string, scheduled time.Time) {
+	n.notify(&Notification{
+		Condition: NotifyWindowMissed,
+		Command:   command,
+		Time:      time.Now(),
+		Scheduled: scheduled,
+	})
+}
+
+func (n *Notifier) notify(msg *Notification) {
+	msg.Host = n.Host
+	for _, rule := range n.Rules {
+		if !slices.Contains(rule.On, msg.Condition) || (len(rule.Commands) != 0 && !slices.Contains(rule.Commands, msg.Command)) {
+			continue
+		}
+		body, err := rule.render(msg)
+		if err != nil {
+			n.Logger.Errorf("Error building webhook body for %v of '%v': %v", msg.Condition, msg.Command, err)
+			continue
+		}
+		for _, url := range rule.URLs {
+			go n.send(rule, url, body)
+		}
+	}
+}
+
+func (r *WebhookRule) render(msg *Notification) ([]byte, error) {
+	if r.Body == nil {
+		return json.Marshal(msg)
+	}
+	var buf bytes.Buffer
+	if err := r.Body.Execute(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// POST the body to the URL, retrying if it fails
+func (n *Notifier) send(rule *WebhookRule, url string, body []byte) {
+	delay := rule.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := n.post(rule, url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= rule.MaxAttempts {
+			n.Logger.Errorf("Webhook %v failed after %v attempts: %v", url, attempt, err)
+			return
+		}
+		n.Logger.Warnf("Webhook %v failed (attempt %v of %v): %v", url, attempt, rule.MaxAttempts, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (n *Notifier) post(rule *WebhookRule, url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	contentType := rule.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range rule.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %v", resp.Status)
+	}
+	return nil
+}
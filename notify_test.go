@@ -0,0 +1,113 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+func TestRunCondition(t *testing.T) {
+	success := &RunRecord{Outcome: OutcomeSuccess}
+	failure := &RunRecord{Outcome: OutcomeFailure}
+	cancelled := &RunRecord{Outcome: OutcomeCancelled}
+	cases := []struct {
+		run, previous *RunRecord
+		expect        NotifyCondition
+	}{
+		{failure, nil, NotifyFailure},
+		{&RunRecord{Outcome: OutcomeStartFailure}, success, NotifyFailure},
+		{&RunRecord{Outcome: OutcomeTimeout}, nil, NotifyTimeout},
+		{success, failure, NotifyRecovery},
+		{&RunRecord{Outcome: OutcomeWarning}, failure, NotifyRecovery},
+		{success, success, ""},
+		{success, nil, ""},
+		{success, cancelled, ""},
+		{cancelled, success, ""},
+	}
+	for i, c := range cases {
+		if cond := runCondition(c.run, c.previous); cond != c.expect {
+			t.Errorf("Case %v: expected '%v', but got '%v'", i, c.expect, cond)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var attempts int32
+	bodies := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt, to exercise the retry
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		raw, _ := io.ReadAll(r.Body)
+		if r.Header.Get("X-Test") != "yes" {
+			t.Errorf("Webhook header missing")
+		}
+		bodies <- raw
+	}))
+	defer server.Close()
+
+	body, err := ParseWebhookTemplate(`{"text": {{json (printf "%v %v on %v" .Command .Condition .Host)}}}`)
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	n := NewNotifier(log.NewTesting(t), []*WebhookRule{
+		{
+			On:          []NotifyCondition{NotifyFailure},
+			Commands:    []string{"import"},
+			URLs:        []string{server.URL},
+			Body:        body,
+			Headers:     map[string]string{"X-Test": "yes"},
+			MaxAttempts: 3,
+			RetryDelay:  10 * time.Millisecond,
+		},
+	})
+	n.Host = `site"1`
+
+	// Neither of these match the rule
+	n.RunFinished(&RunRecord{Command: "backup", Outcome: OutcomeFailure}, nil)
+	n.RunFinished(&RunRecord{Command: "import", Outcome: OutcomeTimeout}, nil)
+
+	n.RunFinished(&RunRecord{Command: "import", Outcome: OutcomeFailure}, nil)
+	select {
+	case raw := <-bodies:
+		msg := map[string]string{}
+		if err := json.Unmarshal(raw, &msg); err != nil || msg["text"] != `import failure on site"1` {
+			t.Errorf("Webhook body incorrect: %s (%v)", raw, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook was not delivered")
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("Expected 2 attempts, but got %v", n)
+	}
+}
+
+func TestWebhookDefaultBody(t *testing.T) {
+	received := make(chan *Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := &Notification{}
+		json.NewDecoder(r.Body).Decode(msg)
+		received <- msg
+	}))
+	defer server.Close()
+
+	n := NewNotifier(log.NewTesting(t), []*WebhookRule{{On: []NotifyCondition{NotifyWindowMissed}, URLs: []string{server.URL}}})
+	scheduled := time.Date(2015, 07, 15, 2, 0, 0, 0, time.UTC)
+	n.WindowMissed("backup", scheduled)
+	select {
+	case msg := <-received:
+		if msg.Condition != NotifyWindowMissed || msg.Command != "backup" || !msg.Scheduled.Equal(scheduled) || msg.Run != nil {
+			t.Errorf("Notification incorrect: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Webhook was not delivered")
+	}
+}
@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every run's stdout and stderr is streamed into its own file, named after the run ID.
+// Files are capped in size, and old files are deleted when there are too many, or when they get too old.
+// This keeps output-heavy jobs debuggable, without sending their output to our logs.
+// There must only be one store per directory, otherwise pruning is not serialized.
+// Once the store is in use, change its limits with SetLimits.
+type OutputStore struct {
+	Dir      string
+	MaxBytes int64         // Maximum size of a single file. Zero means no limit.
+	MaxFiles int           // Maximum number of files to keep. Zero means no limit.
+	MaxAge   time.Duration // Maximum age of files to keep. Zero means no limit.
+	lock     sync.Mutex    // Serializes pruning, and guards the limits
+}
+
+// The output file of a single run. Stdout and stderr are written into the same file.
+type OutputFile struct {
+	Filename  string
+	file      *os.File
+	maxBytes  int64
+	written   int64
+	truncated bool
+	lock      sync.Mutex
+}
+
+const outputFileExt = ".log"
+
+// Create the output file for a run, and delete old files
+func (s *OutputStore) Create(runID string) (*OutputFile, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(s.Dir, runID+outputFileExt)
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes := s.prune(time.Now())
+	return &OutputFile{
+		Filename: filename,
+		file:     f,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+// Change the limits of a store that may be in use
+func (s *OutputStore) SetLimits(maxBytes int64, maxFiles int, maxAge time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.MaxBytes = maxBytes
+	s.MaxFiles = maxFiles
+	s.MaxAge = maxAge
+}
+
+// Open the output file of a run, for reading
+func (s *OutputStore) Open(runID string) (*os.File, error) {
+	// Don't allow a run ID such as "../../secret"
+	if runID == "" || strings.ContainsAny(runID, `/\:.`) {
+		return nil, errors.New("Invalid run ID")
+	}
+	return os.Open(filepath.Join(s.Dir, runID+outputFileExt))
+}
+
+// Delete files that are beyond our retention limits. Returns MaxBytes, which is read under the same lock.
+// Run IDs sort by start time, so the file names tell us which files are the oldest.
+func (s *OutputStore) prune(now time.Time) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return s.MaxBytes
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), outputFileExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		remove := s.MaxFiles > 0 && len(names)-i > s.MaxFiles
+		if !remove && s.MaxAge > 0 {
+			if info, err := os.Stat(filepath.Join(s.Dir, name)); err == nil && now.Sub(info.ModTime()) > s.MaxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(filepath.Join(s.Dir, name))
+		}
+	}
+	return s.MaxBytes
+}
+
+// Write to the file, until it reaches its size limit. We never return an error,
+// because that would cause exec.Cmd to stop copying output, and the job could block
+// on a full pipe.
+func (f *OutputFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.truncated {
+		return len(p), nil
+	}
+	b := p
+	if f.maxBytes > 0 && f.written+int64(len(b)) > f.maxBytes {
+		b = b[:f.maxBytes-f.written]
+		f.truncated = true
+	}
+	n, _ := f.file.Write(b)
+	f.written += int64(n)
+	if f.truncated {
+		fmt.Fprintf(f.file, "\n...(output truncated at %v bytes)...\n", f.maxBytes)
+	}
+	return len(p), nil
+}
+
+func (f *OutputFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
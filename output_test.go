@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputFileLimit(t *testing.T) {
+	s := &OutputStore{Dir: t.TempDir(), MaxBytes: 10}
+	f, err := s.Create("run-1")
+	if err != nil {
+		t.Fatalf("Failed to create output file: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if n, err := f.Write([]byte("hello\n")); n != 6 || err != nil {
+			t.Fatalf("Write must always succeed, but got %v, %v", n, err)
+		}
+	}
+	f.Close()
+
+	r, err := s.Open("run-1")
+	if err != nil {
+		t.Fatalf("Failed to open output file: %v", err)
+	}
+	defer r.Close()
+	raw, _ := io.ReadAll(r)
+	if !strings.HasPrefix(string(raw), "hello\nhell\n") || !strings.Contains(string(raw), "truncated") {
+		t.Errorf("Truncated output incorrect: %q", raw)
+	}
+}
+
+func TestOutputStorePrune(t *testing.T) {
+	s := &OutputStore{Dir: t.TempDir(), MaxFiles: 3}
+	for i := 0; i < 5; i++ {
+		f, err := s.Create(fmt.Sprintf("run-%v", i))
+		if err != nil {
+			t.Fatalf("Failed to create output file: %v", err)
+		}
+		f.Close()
+	}
+	for i := 0; i < 5; i++ {
+		_, err := os.Stat(filepath.Join(s.Dir, fmt.Sprintf("run-%v.log", i)))
+		if exists := err == nil; exists != (i >= 2) {
+			t.Errorf("run-%v: expected exists = %v", i, i >= 2)
+		}
+	}
+
+	// Retention by age
+	s.SetLimits(0, 0, time.Hour)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(s.Dir, "run-2.log"), old, old)
+	s.prune(time.Now())
+	if _, err := os.Stat(filepath.Join(s.Dir, "run-2.log")); err == nil {
+		t.Errorf("Old output file was not deleted")
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "run-3.log")); err != nil {
+		t.Errorf("Recent output file was deleted")
+	}
+}
+
+func TestOutputStoreOpenInvalid(t *testing.T) {
+	s := &OutputStore{Dir: t.TempDir()}
+	for _, id := range []string{"", "../secret", "a/b", `a\b`, "c:x"} {
+		if _, err := s.Open(id); err == nil {
+			t.Errorf("Expected Open(%q) to fail", id)
+		}
+	}
+}
+
+func TestRunWritesOutputFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test relies on sh")
+	}
+	s := &OutputStore{Dir: t.TempDir()}
+	c := &Command{
+		Name:    "output",
+		Exec:    "sh",
+		Params:  []string{"-c", "echo out; echo err 1>&2"},
+		Timeout: 10 * time.Second,
+		Output:  s,
+	}
+	run := waitForRun(t, startCommand(t, c))
+	if run.OutputFile == "" {
+		t.Fatalf("Run has no output file")
+	}
+	raw, err := os.ReadFile(run.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output file: %v", err)
+	}
+	if !strings.Contains(string(raw), "out\n") || !strings.Contains(string(raw), "err\n") {
+		t.Errorf("Output file incorrect: %q", raw)
+	}
+}
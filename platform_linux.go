@@ -0,0 +1,115 @@
+//go:build linux
+
+package scheduler
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+const prSetChildSubreaper = 36
+
+// How often we look for orphans to reap
+const reaperInterval = 5 * time.Second
+
+// Basic information from /proc/<pid>/stat
+type procStat struct {
+	pid   int
+	state byte
+	ppid  int
+	pgrp  int
+}
+
+// Become a "child subreaper", so that the orphaned children of our jobs are re-parented to
+// us instead of to init, and then reap those orphans when they exit, so that they don't
+// linger as zombies.
+func StartReaper(logger *log.Logger) {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		logger.Errorf("Failed to become child subreaper: %v", errno)
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(reaperInterval)
+			reapOrphans()
+		}
+	}()
+}
+
+// Reap zombies that were orphaned by our jobs.
+// We must not reap the processes of running jobs, because exec.Cmd.Wait() needs to do that.
+// We also leave alone the direct children that were launched by any other part of this program,
+// which we recognize because they share our process group. Every job runs in its own process group.
+func reapOrphans() {
+	self := os.Getpid()
+	selfGroup := syscall.Getpgrp()
+	children.lock.Lock()
+	defer children.lock.Unlock()
+	for _, p := range readAllProcStats() {
+		if p.ppid == self && p.state == 'Z' && p.pgrp != selfGroup && !children.pids[p.pid] {
+			var status syscall.WaitStatus
+			syscall.Wait4(p.pid, &status, syscall.WNOHANG, nil)
+		}
+	}
+}
+
+// Find all descendants of pid
+func processDescendants(pid int) []int {
+	byParent := map[int][]int{}
+	for _, p := range readAllProcStats() {
+		byParent[p.ppid] = append(byParent[p.ppid], p.pid)
+	}
+	result := []int{}
+	queue := byParent[pid]
+	for len(queue) != 0 {
+		p := queue[0]
+		queue = queue[1:]
+		result = append(result, p)
+		queue = append(queue, byParent[p]...)
+	}
+	return result
+}
+
+func readAllProcStats() []procStat {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	result := []procStat{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if p, ok := readProcStat(pid); ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func readProcStat(pid int) (procStat, bool) {
+	raw, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return procStat{}, false
+	}
+	// The format is "pid (comm) state ppid pgrp ...", and comm may contain spaces and parentheses
+	s := string(raw)
+	closeParen := strings.LastIndexByte(s, ')')
+	if closeParen == -1 {
+		return procStat{}, false
+	}
+	fields := strings.Fields(s[closeParen+1:])
+	if len(fields) < 3 || len(fields[0]) != 1 {
+		return procStat{}, false
+	}
+	p := procStat{pid: pid, state: fields[0][0]}
+	p.ppid, _ = strconv.Atoi(fields[1])
+	p.pgrp, _ = strconv.Atoi(fields[2])
+	return p, true
+}
@@ -1,13 +1,14 @@
-//go:build !windows
+//go:build !windows && !linux
 
 package scheduler
 
-import "syscall"
+import "github.com/IMQS/log"
 
-func killProcessTree(pid int) bool {
-	err := syscall.Kill(-pid, syscall.SIGKILL)
-	if err != nil {
-		return false
-	}
-	return true
+// Reaping orphans is only implemented on Linux
+func StartReaper(logger *log.Logger) {
+}
+
+// Finding descendants is only implemented on Linux, so we rely on the process group alone
+func processDescendants(pid int) []int {
+	return nil
 }
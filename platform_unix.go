@@ -0,0 +1,46 @@
+//go:build !windows
+
+package scheduler
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Start every job in its own process group, so that we can signal the job and everything that it spawned
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
+
+// Returns the name of the signal that terminated the process, or an empty string if it exited by itself
+func exitSignal(state *os.ProcessState) string {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal().String()
+	}
+	return ""
+}
+
+// Ask the process tree to terminate
+func terminateProcessTree(pid int) bool {
+	return signalProcessTree(pid, syscall.SIGTERM)
+}
+
+func killProcessTree(pid int) bool {
+	return signalProcessTree(pid, syscall.SIGKILL)
+}
+
+// Signal the process group that we created for the job, as well as any descendants
+// that have moved themselves out of that group.
+func signalProcessTree(pid int, sig syscall.Signal) bool {
+	// Find the descendants before we signal anything, because once a process dies, its children are re-parented
+	descendants := processDescendants(pid)
+	err := syscall.Kill(-pid, sig)
+	for _, d := range descendants {
+		syscall.Kill(d, sig)
+	}
+	// ESRCH means that there was nothing left to signal
+	return err == nil || err == syscall.ESRCH
+}
@@ -3,10 +3,39 @@
 package scheduler
 
 import (
+	"os"
 	"os/exec"
 	"strconv"
+	"syscall"
+
+	"github.com/IMQS/log"
 )
 
+var procGenerateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// Start every process in a new process group, so that we can send CTRL_BREAK to it
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
+
+// Windows has no signals. A process that is killed simply exits with the code that the killer chose.
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// Send CTRL_BREAK to the process group. This only works if the process shares a console with us,
+// so it will usually fail when we're running as a service. The caller then falls back to killProcessTree.
+func terminateProcessTree(pid int) bool {
+	r, _, _ := procGenerateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(pid))
+	return r != 0
+}
+
+// taskkill /T already kills the whole tree, and Windows has no zombies to reap
+func StartReaper(logger *log.Logger) {
+}
+
 // We need a function for killing a process and it's offspring, leaving no traces after the attempt.
 // This is especially necessary for sufficiently killing all git subprocesses.
 func killProcessTree(pid int) bool {
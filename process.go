@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+// How we stopped a process that we didn't want to wait for any longer
+type Termination string
+
+const (
+	TerminationGraceful   Termination = "graceful"    // The process exited after we asked it to
+	TerminationKilled     Termination = "killed"      // We killed the process tree
+	TerminationKillFailed Termination = "kill-failed" // We tried to kill the process tree, but failed
+)
+
+// The processes of the jobs that are currently running.
+// The reaper on Linux must leave these alone, because exec.Cmd.Wait() reaps them.
+var children = struct {
+	lock sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+// Start the process, and register it as a running job.
+// We hold the lock across Start(), so that the reaper can't see the process before it is registered.
+func startChild(cmd *exec.Cmd) error {
+	children.lock.Lock()
+	defer children.lock.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// Wait for the process to exit, and unregister it
+func waitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	children.lock.Lock()
+	delete(children.pids, cmd.Process.Pid)
+	children.lock.Unlock()
+	return err
+}
+
+// Stop a process tree.
+// If gracePeriod is positive, then we first ask the process to terminate (SIGTERM, or CTRL_BREAK on Windows),
+// and only kill it if it has not exited within the grace period. donec must receive the result of cmd.Wait().
+func stopProcess(logger *log.Logger, name string, pid int, gracePeriod time.Duration, donec <-chan error) Termination {
+	if gracePeriod > 0 {
+		if terminateProcessTree(pid) {
+			logger.Infof("Asked %v to terminate. Waiting up to %v before killing it.", name, gracePeriod)
+			select {
+			case <-donec:
+				logger.Infof("%v terminated gracefully", name)
+				return TerminationGraceful
+			case <-time.After(gracePeriod):
+				logger.Errorf("%v did not terminate within %v", name, gracePeriod)
+			}
+		} else {
+			logger.Errorf("Failed to ask %v to terminate", name)
+		}
+	}
+	logger.Infof("Killing %v", name)
+	if !killProcessTree(pid) {
+		logger.Errorf("Failed to kill process.")
+		return TerminationKillFailed
+	}
+	return TerminationKilled
+}
@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns true if the process is gone, or is a zombie
+func processIsDead(pid int) bool {
+	raw, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	s := string(raw)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	return fields[0] == "Z"
+}
+
+func waitForRun(t *testing.T, finished chan *RunRecord) *RunRecord {
+	select {
+	case run := <-finished:
+		return run
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Command did not finish")
+	}
+	return nil
+}
+
+func TestTimeoutKillsProcessTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Test relies on /proc")
+	}
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	// The grandchild moves itself into a new session, so killing the process group is not enough
+	c := &Command{
+		Name:    "tree",
+		Exec:    "sh",
+		Params:  []string{"-c", "setsid sleep 30 & echo $! > " + pidFile + "; sleep 30"},
+		Timeout: 500 * time.Millisecond,
+	}
+	run := waitForRun(t, startCommand(t, c))
+	if run.Outcome != OutcomeTimeout || run.Termination != TerminationKilled {
+		t.Fatalf("Expected timeout and kill, but got %v %v", run.Outcome, run.Termination)
+	}
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read grandchild pid: %v", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
+	time.Sleep(100 * time.Millisecond)
+	if !processIsDead(pid) {
+		t.Errorf("Grandchild %v survived", pid)
+	}
+}
+
+func TestGracefulTermination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{
+		Name:        "graceful",
+		Exec:        "sh",
+		Params:      []string{"-c", "trap 'exit 3' TERM; sleep 30 & wait"},
+		Timeout:     500 * time.Millisecond,
+		GracePeriod: 5 * time.Second,
+	}
+	run := waitForRun(t, startCommand(t, c))
+	if run.Outcome != OutcomeTimeout || run.Termination != TerminationGraceful || run.ExitCode != 3 {
+		t.Errorf("Expected graceful termination with exit code 3, but got %v %v %v", run.Outcome, run.Termination, run.ExitCode)
+	}
+
+	// A process that ignores SIGTERM is killed after the grace period
+	c = &Command{
+		Name:        "stubborn",
+		Exec:        "sh",
+		Params:      []string{"-c", "trap '' TERM; sleep 30"},
+		Timeout:     500 * time.Millisecond,
+		GracePeriod: 500 * time.Millisecond,
+	}
+	run = waitForRun(t, startCommand(t, c))
+	if run.Termination != TerminationKilled {
+		t.Errorf("Expected stubborn process to be killed, but got %v", run.Termination)
+	}
+}
+
+func TestStoppedRunsKeepOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	c := &Command{
+		Name:    "slow",
+		Exec:    "sh",
+		Params:  []string{"-c", "echo working; echo stuck >&2; sleep 30"},
+		Timeout: 500 * time.Millisecond,
+	}
+	run := waitForRun(t, startCommand(t, c))
+	if run.Outcome != OutcomeTimeout || run.Stdout != "working\n" || run.Stderr != "stuck\n" {
+		t.Errorf("Timed out run lost its output: %v %q %q", run.Outcome, run.Stdout, run.Stderr)
+	}
+
+	c = &Command{
+		Name:    "slow",
+		Exec:    "sh",
+		Params:  []string{"-c", "echo working; echo stuck >&2; sleep 30"},
+		Timeout: time.Minute,
+	}
+	finished := startCommand(t, c)
+	time.Sleep(200 * time.Millisecond)
+	if !c.Cancel() {
+		t.Fatalf("Cancel failed")
+	}
+	run = waitForRun(t, finished)
+	if run.Outcome != OutcomeCancelled || run.Stdout != "working\n" || run.Stderr != "stuck\n" {
+		t.Errorf("Cancelled run lost its output: %v %q %q", run.Outcome, run.Stdout, run.Stderr)
+	}
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"time"
+)
+
+// Retry a failed run after a delay, which grows with every attempt.
+// Retries go through MustRun and NextRunnable like any other run, so they respect pools and priority.
+// A retry of a daily or cron task must start within the same start window as a scheduled run, so a
+// nightly backup never retries during the day. If it can't, then the retry is dropped.
+// A retry runs with the same variables as the run that failed.
+type RetryPolicy struct {
+	MaxAttempts    int           // Maximum number of retries after a failed run. Zero disables retries.
+	InitialDelay   time.Duration // Delay before the first retry
+	Multiplier     float64       // Each subsequent delay is multiplied by this. Values less than 1 are treated as 1.
+	ExitCodes      []int         // Exit codes that are retryable. If empty, then any failed exit code is retryable.
+	OnTimeout      bool          // Retry runs that time out
+	OnStartFailure bool          // Retry runs whose process could not be started
+}
+
+// Returns true if the outcome of the run warrants a retry
+func (p *RetryPolicy) isRetryable(run *RunRecord) bool {
+	switch run.Outcome {
+	case OutcomeFailure:
+		if len(p.ExitCodes) == 0 {
+			return true
+		}
+		for _, code := range p.ExitCodes {
+			if code == run.ExitCode {
+				return true
+			}
+		}
+		return false
+	case OutcomeTimeout:
+		return p.OnTimeout
+	case OutcomeStartFailure:
+		return p.OnStartFailure
+	}
+	return false
+}
+
+// Returns the delay before the given retry attempt, where the first retry is attempt 1
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		d *= multiplier
+	}
+	return time.Duration(d)
+}
+
+// Decide whether to retry, after a run has finished. variables are the variables of the run.
+// cfg is the copy of the config that the run was launched with (see runConfig), which
+// gives the retry policy and the start window.
+// This is called from the command's goroutine, before it is marked as no longer running.
+// Returns the time of the retry (zero if there is none), and the number of the retry.
+func (c *Command) scheduleRetry(cfg *Command, run *RunRecord, variables map[string]string) (time.Time, int) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	retryAt := time.Time{}
+	if cfg.Retry.MaxAttempts > 0 && c.retryCount < cfg.Retry.MaxAttempts && cfg.Retry.isRetryable(run) {
+		retryAt = run.Finished.Add(cfg.Retry.delay(c.retryCount + 1))
+	}
+	if !retryAt.IsZero() && cfg.inStartWindow(retryAt) {
+		c.retryCount++
+		c.retryAt = retryAt
+		c.retryVariables = variables
+	} else {
+		c.retryCount = 0
+		c.retryAt = time.Time{}
+		c.retryVariables = nil
+	}
+	return c.retryAt, c.retryCount
+}
+
+// Forget about the pending retry
+func (c *Command) cancelRetry() {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	c.retryCount = 0
+	c.retryAt = time.Time{}
+	c.retryVariables = nil
+}
+
+// Returns true if a daily or cron task may start at the given time. Other tasks may start at any time.
+func (c *Command) inStartWindow(at time.Time) bool {
+	if c.isDaily() {
+		return at.Sub(c.mostRecentStartTime(at)) < dailyCommandWindow
+	} else if c.Cron != nil {
+		fired := c.Cron.Next(at.Add(-dailyCommandWindow))
+		return !fired.IsZero() && !fired.After(at)
+	}
+	return true
+}
+
+// Returns the time of the pending retry, or the zero time if there is none
+func (c *Command) retryTime() time.Time {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	return c.retryAt
+}
+
+// Returns true if a retry is pending, and its delay has elapsed
+func (c *Command) retryDue(now time.Time) bool {
+	retryAt := c.retryTime()
+	return !retryAt.IsZero() && !now.Before(retryAt)
+}
@@ -0,0 +1,156 @@
+package scheduler
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/IMQS/log"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Minute,
+		Multiplier:   2,
+		ExitCodes:    []int{1, 5},
+		OnTimeout:    true,
+	}
+	if !p.isRetryable(&RunRecord{Outcome: OutcomeFailure, ExitCode: 5}) || p.isRetryable(&RunRecord{Outcome: OutcomeFailure, ExitCode: 2}) {
+		t.Errorf("Exit codes not respected")
+	}
+	if !p.isRetryable(&RunRecord{Outcome: OutcomeTimeout}) || p.isRetryable(&RunRecord{Outcome: OutcomeStartFailure}) {
+		t.Errorf("Outcomes not respected")
+	}
+	if p.isRetryable(&RunRecord{Outcome: OutcomeSuccess}) || p.isRetryable(&RunRecord{Outcome: OutcomeCancelled}) {
+		t.Errorf("Success and cancellation must never be retried")
+	}
+	if p.delay(1) != time.Minute || p.delay(2) != 2*time.Minute || p.delay(3) != 4*time.Minute {
+		t.Errorf("Backoff incorrect: %v %v %v", p.delay(1), p.delay(2), p.delay(3))
+	}
+}
+
+func TestRetries(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 2, 0, 0, 0, loc)
+
+	backup := &Command{
+		Name:     "backup",
+		Pool:     "db",
+		Enabled:  true,
+		Interval: 24 * time.Hour,
+		Retry:    RetryPolicy{MaxAttempts: 2, InitialDelay: 10 * time.Minute, Multiplier: 3},
+	}
+	backup.SetStartTime(2, 0)
+	backup.lastRun = nowPresent
+	failed := &RunRecord{Outcome: OutcomeFailure, ExitCode: 1, Finished: nowPresent.Add(time.Minute)}
+
+	backup.scheduleRetry(backup, failed, nil)
+	if backup.MustRun(nowPresent.Add(10*time.Minute)) || !backup.MustRun(nowPresent.Add(11*time.Minute)) {
+		t.Errorf("First retry not scheduled correctly")
+	}
+
+	// Retries respect pools
+	other := &Command{Name: "other", Pool: "db", Enabled: true, Interval: time.Hour, isRunningAtomic: 1}
+	if next := NextRunnable([]*Command{backup, other}, nowPresent.Add(time.Hour)); next != nil {
+		t.Errorf("Retry must wait for its pool")
+	}
+	other.isRunningAtomic = 0
+
+	backup.lastRun = nowPresent.Add(11 * time.Minute)
+	failed.Finished = nowPresent.Add(12 * time.Minute)
+	backup.scheduleRetry(backup, failed, nil)
+	if backup.MustRun(nowPresent.Add(41*time.Minute)) || !backup.MustRun(nowPresent.Add(42*time.Minute)) {
+		t.Errorf("Second retry not scheduled correctly")
+	}
+
+	// We've run out of attempts
+	backup.lastRun = nowPresent.Add(42 * time.Minute)
+	failed.Finished = nowPresent.Add(43 * time.Minute)
+	backup.scheduleRetry(backup, failed, nil)
+	if backup.MustRun(nowPresent.Add(5 * time.Hour)) {
+		t.Errorf("Retried too many times")
+	}
+
+	// Success resets the count
+	backup.scheduleRetry(backup, &RunRecord{Outcome: OutcomeSuccess}, nil)
+	if backup.retryCount != 0 || !backup.retryAt.IsZero() {
+		t.Errorf("Success did not reset retries")
+	}
+}
+
+func TestRetriesRespectStartWindow(t *testing.T) {
+	loc := time.FixedZone("Pretoria", -7200)
+	nowPresent := time.Date(2015, 07, 15, 2, 0, 0, 0, loc)
+
+	backup := &Command{
+		Name:     "backup",
+		Pool:     "db",
+		Enabled:  true,
+		Interval: 24 * time.Hour,
+		Retry:    RetryPolicy{MaxAttempts: 2, InitialDelay: 3 * time.Hour},
+	}
+	backup.SetStartTime(2, 0)
+	backup.lastRun = nowPresent
+
+	// A retry that would start after the window has closed is dropped
+	backup.scheduleRetry(backup, &RunRecord{Outcome: OutcomeFailure, ExitCode: 1, Finished: nowPresent.Add(time.Minute)}, nil)
+	if !backup.retryAt.IsZero() || backup.MustRun(nowPresent.Add(3*time.Hour+time.Minute)) {
+		t.Errorf("Retry outside of the start window must be dropped")
+	}
+
+	// A retry that is held up by a busy pool until the window has closed is dropped
+	backup.Retry.InitialDelay = 10 * time.Minute
+	backup.scheduleRetry(backup, &RunRecord{Outcome: OutcomeFailure, ExitCode: 1, Finished: nowPresent.Add(time.Minute)}, nil)
+	if !backup.MustRun(nowPresent.Add(11 * time.Minute)) {
+		t.Fatalf("Retry within the start window must run")
+	}
+	if backup.MustRun(nowPresent.Add(8 * time.Hour)) {
+		t.Errorf("Retry must not run after the start window has closed")
+	}
+	if !backup.retryAt.IsZero() || backup.retryCount != 0 {
+		t.Errorf("Retry that missed its window was not dropped")
+	}
+
+	// Cron tasks have the same window
+	cron, _ := ParseCron("0 2 * * *")
+	nightly := &Command{Name: "nightly", Enabled: true, Cron: cron, lastRun: nowPresent, Retry: RetryPolicy{MaxAttempts: 1, InitialDelay: 3 * time.Hour}}
+	nightly.scheduleRetry(nightly, &RunRecord{Outcome: OutcomeFailure, ExitCode: 1, Finished: nowPresent.Add(time.Minute)}, nil)
+	if !nightly.retryAt.IsZero() {
+		t.Errorf("Cron retry outside of the start window must be dropped")
+	}
+
+	// Interval tasks have no window
+	regular := &Command{Name: "regular", Enabled: true, Interval: 12 * time.Hour, lastRun: nowPresent, Retry: RetryPolicy{MaxAttempts: 1, InitialDelay: 3 * time.Hour}}
+	regular.scheduleRetry(regular, &RunRecord{Outcome: OutcomeFailure, ExitCode: 1, Finished: nowPresent.Add(time.Minute)}, nil)
+	if !regular.MustRun(nowPresent.Add(3*time.Hour + time.Minute)) {
+		t.Errorf("Interval task must retry at any time")
+	}
+}
+
+func TestRetryKeepsVariables(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Test uses unix commands")
+	}
+	finished := make(chan *RunRecord, 1)
+	c := &Command{
+		Name:     "import",
+		Enabled:  true,
+		Interval: time.Hour,
+		Exec:     "sh",
+		Params:   []string{"-c", "echo !BATCH; exit 1"},
+		Timeout:  10 * time.Second,
+		Retry:    RetryPolicy{MaxAttempts: 1, InitialDelay: time.Millisecond},
+		OnFinish: func(c *Command, run *RunRecord) { finished <- run },
+	}
+	logger := log.NewTesting(t)
+	c.Run(logger, map[string]string{"BATCH": "batch1"}, TriggerHttp)
+	if run := waitForRun(t, finished); run.Stdout != "batch1\n" {
+		t.Fatalf("Unexpected output of first run: %q", run.Stdout)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Run(logger, map[string]string{"BATCH": "default"}, TriggerSchedule)
+	if run := waitForRun(t, finished); run.Trigger != TriggerRetry || run.Stdout != "batch1\n" {
+		t.Errorf("Retry must run with the variables of the failed run, but got %v %q", run.Trigger, run.Stdout)
+	}
+}
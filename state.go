@@ -0,0 +1,113 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The last start, finish, and success time of a command
+type CommandState struct {
+	LastStart   time.Time
+	LastFinish  time.Time
+	LastSuccess time.Time
+	Enabled     *bool `json:",omitempty"` // If not nil, then the command was enabled or disabled from the API, which overrides the config
+}
+
+// The state file remembers when every command last ran.
+// Without this, a restart of the scheduler would make every interval task overdue at
+// once, and a restart inside the start window of a daily task would run it again.
+type StateFile struct {
+	Filename string
+	Commands map[string]CommandState
+	lock     sync.Mutex
+}
+
+// Load the state file. If the file does not exist, then the state is empty, and no error is returned.
+func LoadStateFile(filename string) (*StateFile, error) {
+	s := &StateFile{
+		Filename: filename,
+		Commands: map[string]CommandState{},
+	}
+	raw, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(raw, &s.Commands); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Restore the lastRun time of the command, if we have a record of it.
+// This is intended to be called on a freshly created command. If the command has
+// already run during the lifetime of this process, then its state is left alone.
+func (s *StateFile) Restore(c *Command) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.Commands[c.Name]
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	if !ok || !c.lastRun.IsZero() {
+		return
+	}
+	c.lastRun = st.LastStart
+	c.lastFinish = st.LastFinish
+	c.lastSuccess = st.LastSuccess
+}
+
+// Record the state of the command, and write the state file to disk
+func (s *StateFile) Record(c *Command) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.Commands[c.Name]
+	st.LastStart = c.LastRun()
+	st.LastFinish = c.LastFinish()
+	st.LastSuccess = c.LastSuccess()
+	s.Commands[c.Name] = st
+	return s.save()
+}
+
+// Override the enabled state of a command, and write the state file to disk.
+// If enabled is nil, then the override is removed, and the config applies again.
+func (s *StateFile) SetEnabled(name string, enabled *bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st := s.Commands[name]
+	st.Enabled = enabled
+	s.Commands[name] = st
+	return s.save()
+}
+
+// Returns the commands whose enabled state has been overridden
+func (s *StateFile) EnabledOverrides() map[string]bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	overrides := map[string]bool{}
+	for name, st := range s.Commands {
+		if st.Enabled != nil {
+			overrides[name] = *st.Enabled
+		}
+	}
+	return overrides
+}
+
+// Write to a temporary file and rename it, so that we never leave a half written state file behind
+func (s *StateFile) save() error {
+	raw, err := json.MarshalIndent(s.Commands, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Filename), 0755); err != nil {
+		return err
+	}
+	tmp := s.Filename + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Filename)
+}
@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state", "state.json")
+
+	s, err := LoadStateFile(filename)
+	if err != nil || len(s.Commands) != 0 {
+		t.Fatalf("Expected empty state from missing file: %v", err)
+	}
+
+	start := time.Date(2015, 07, 15, 2, 0, 0, 0, time.UTC)
+	backup := &Command{Name: "backup", lastRun: start, lastFinish: start.Add(time.Hour)}
+	if err := s.Record(backup); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	s, err = LoadStateFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	restored := &Command{Name: "backup"}
+	s.Restore(restored)
+	if !restored.LastRun().Equal(start) || !restored.LastFinish().Equal(start.Add(time.Hour)) {
+		t.Errorf("State not restored: %v %v", restored.LastRun(), restored.LastFinish())
+	}
+
+	// Don't clobber a command that has already run
+	ran := &Command{Name: "backup", lastRun: start.Add(24 * time.Hour)}
+	s.Restore(ran)
+	if !ran.LastRun().Equal(start.Add(24 * time.Hour)) {
+		t.Errorf("State of running command was clobbered")
+	}
+
+	// Enabled overrides survive a reload, and are not clobbered by Record
+	disabled := false
+	if err := s.SetEnabled("backup", &disabled); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	s.Record(backup)
+	s, _ = LoadStateFile(filename)
+	if overrides := s.EnabledOverrides(); len(overrides) != 1 || overrides["backup"] != false {
+		t.Errorf("Enabled override not restored: %v", overrides)
+	}
+	s.SetEnabled("backup", nil)
+	if overrides := s.EnabledOverrides(); len(overrides) != 0 {
+		t.Errorf("Enabled override not removed: %v", overrides)
+	}
+
+	// Unknown commands are left alone
+	unknown := &Command{Name: "unknown"}
+	s.Restore(unknown)
+	if !unknown.LastRun().IsZero() {
+		t.Errorf("Unknown command received state")
+	}
+}
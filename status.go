@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot of a command's configuration and live state, for reporting
+type CommandStatus struct {
+	Name        string
+	Pool        string
+	Enabled     bool
+	Interval    string   `json:",omitempty"` // Empty for cron, weekly, and monthly tasks
+	StartTime   string   `json:",omitempty"` // Only for daily tasks, eg "02:30"
+	Cron        string   `json:",omitempty"`
+	After       []string `json:",omitempty"`
+	Timeout     string
+	LastRun     time.Time
+	LastFinish  time.Time
+	LastSuccess time.Time
+	Running     bool
+	Queued      bool
+	NextRun     time.Time // Zero if the task will never run again
+	Overdue     float64   // Seconds. Negative if the task is not yet due.
+}
+
+// Produce a snapshot of the command's state
+func (c *Command) Status(now time.Time) CommandStatus {
+	s := CommandStatus{
+		Name:        c.Name,
+		Pool:        c.Pool,
+		Enabled:     c.Enabled,
+		Timeout:     c.Timeout.String(),
+		LastRun:     c.LastRun(),
+		LastFinish:  c.LastFinish(),
+		LastSuccess: c.LastSuccess(),
+		Running:     atomic.LoadInt32(&c.isRunningAtomic) != 0,
+		Queued:      !c.queuedTime().IsZero(),
+		NextRun:     c.nextDue(now),
+		Overdue:     c.timeOverdue(now).Seconds(),
+	}
+	if c.isDependent() {
+		s.After = c.After
+	} else if c.Cron != nil {
+		s.Cron = c.Cron.String()
+	} else {
+		s.Interval = c.Interval.String()
+	}
+	if c.isDaily() {
+		s.StartTime = c.StartTime.Format("15:04")
+	}
+	return s
+}
+
+// Returns the time when the command is (or was) next due to run.
+// This ignores whether the command is enabled, or is already running.
+func (c *Command) nextDue(now time.Time) time.Time {
+	if queuedAt := c.queuedTime(); !queuedAt.IsZero() {
+		return queuedAt
+	} else if c.isDependent() {
+		return c.dependenciesReady()
+	} else if c.Cron != nil {
+		return c.nextCronRun(now)
+	} else if c.isDaily() {
+		start := c.mostRecentStartTime(now)
+		if now.Sub(start) < dailyCommandWindow && now.Sub(c.LastRun()) > dailyCommandWindow {
+			return start
+		}
+		return start.Add(24 * time.Hour)
+	} else if !c.hasSchedule() {
+		return time.Time{}
+	} else {
+		lastRun := c.LastRun()
+		if lastRun.IsZero() {
+			return now
+		}
+		return lastRun.Add(c.Interval)
+	}
+}